@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Gleipnir-Technology/flogo/process"
+	"github.com/Gleipnir-Technology/flogo/state"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+type EventAnalyzerType int
+
+const (
+	// The analyzers ran, whether or not they found anything
+	EventAnalyzeDone EventAnalyzerType = iota
+	// An analyzer couldn't run
+	EventAnalyzeFailure
+	EventAnalyzeStart
+)
+
+type EventAnalyzer struct {
+	Diagnostics []*state.Diagnostic
+	Process     *state.Process
+	Type        EventAnalyzerType
+}
+
+// Analyzer runs 'go vet' and linters after each successful build. What they
+// find is only a warning, so the runner doesn't wait for them.
+type Analyzer struct {
+	// The analyzers to run, in order. Each prints problems as 'file:line:col: message'.
+	Commands  [][]string
+	OnEvent   chan<- EventAnalyzer
+	Target    string
+	ToAnalyze <-chan struct{}
+}
+
+// analysis is a run of the analyzers, one after another
+type analysis struct {
+	diagnostics []*state.Diagnostic
+	failed      bool
+	// The output of the analyzers that have finished
+	output  *process.Lines
+	process *process.Process
+	step    int
+	sub     *process.Subscription[process.EventProcess]
+}
+
+// events gets the events of the analyzer that is running, or nil if there isn't one
+func (an *analysis) events() <-chan process.EventProcess {
+	if an == nil || an.sub == nil {
+		return nil
+	}
+	return an.sub.C
+}
+
+func (a *Analyzer) Run(ctx context.Context) error {
+	logger := log.Ctx(ctx).With().Caller().Logger()
+	var current *analysis
+	logger.Info().Msg("Started analyzer loop")
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info().Msg("Shutdown analyzer")
+			a.stop(current)
+			return nil
+		case evt := <-current.events():
+			if evt.Type == process.EventProcessStop {
+				a.onStepExit(ctx, logger, current, evt.ProcessState)
+			}
+		case <-a.ToAnalyze:
+			a.stop(current)
+			current = &analysis{
+				diagnostics: []*state.Diagnostic{},
+				output:      process.NewLines(process.DefaultCapacity),
+			}
+			a.OnEvent <- EventAnalyzer{
+				Diagnostics: current.diagnostics,
+				Process:     nil,
+				Type:        EventAnalyzeStart,
+			}
+			a.startStep(ctx, logger, current)
+		}
+	}
+}
+
+func (a *Analyzer) startStep(ctx context.Context, logger zerolog.Logger, an *analysis) {
+	command := a.Commands[an.step]
+	p := process.New(command[0], command[1:]...)
+	p.SetDir(a.Target)
+	an.process = p
+	an.sub = p.OnEvent.Subscribe()
+	err := p.Start(ctx)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to start analyzer")
+		an.sub.Close()
+		an.sub = nil
+		an.failed = true
+		an.output.Append(process.StreamStderr, fmt.Appendf(nil, "flogo: %v", err))
+		a.next(ctx, logger, an)
+	}
+}
+
+// stop abandons the analysis, if it is still going
+func (a *Analyzer) stop(an *analysis) {
+	if an == nil || an.sub == nil {
+		return
+	}
+	an.sub.Close()
+	an.sub = nil
+	an.process.Stop()
+}
+
+func (a *Analyzer) onStepExit(ctx context.Context, logger zerolog.Logger, an *analysis, s *os.ProcessState) {
+	an.sub.Close()
+	an.sub = nil
+	command := a.Commands[an.step]
+	lines, _ := an.process.Output().Since(0)
+	for _, line := range lines {
+		an.output.AppendLine(line)
+	}
+	diagnostics := parseDiagnostics(analyzerName(command), an.process.Output().Bytes())
+	an.diagnostics = append(an.diagnostics, diagnostics...)
+	// Analyzers usually exit with an error when they find something, so it's
+	// only a failure if they didn't say what
+	if i := s.ExitCode(); i != 0 && len(diagnostics) == 0 {
+		an.failed = true
+		an.output.Append(process.StreamStderr, fmt.Appendf(nil, "flogo: analyzer '%s' failed with exit code %d", strings.Join(command, " "), i))
+	}
+	a.next(ctx, logger, an)
+}
+
+// next starts the next analyzer, or reports what they all found
+func (a *Analyzer) next(ctx context.Context, logger zerolog.Logger, an *analysis) {
+	an.step++
+	if an.step < len(a.Commands) {
+		a.startStep(ctx, logger, an)
+		return
+	}
+	t := EventAnalyzeDone
+	if an.failed {
+		t = EventAnalyzeFailure
+	}
+	logger.Debug().Int("diagnostics", len(an.diagnostics)).Msg("analysis done")
+	a.OnEvent <- EventAnalyzer{
+		Diagnostics: an.diagnostics,
+		Process: &state.Process{
+			ExitCode: nil,
+			Output:   an.output,
+		},
+		Type: t,
+	}
+}
+
+// analyzerName gets what to call the analyzer in diagnostics, like "go vet" or "staticcheck"
+func analyzerName(command []string) string {
+	name := filepath.Base(command[0])
+	if name == "go" && len(command) > 1 {
+		return name + " " + command[1]
+	}
+	return name
+}
+
+// Pattern: filename:line:column: message, where the column is optional
+var diagnosticPattern = regexp.MustCompile(`^(.+?):(\d+)(?::(\d+))?: (.+)$`)
+
+// parseDiagnostics finds the problems in the output of an analyzer
+func parseDiagnostics(source string, output []byte) []*state.Diagnostic {
+	result := make([]*state.Diagnostic, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		// 'go vet' reports type errors as "vet: file:line:col: message"
+		line := strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "vet: ")
+		matches := diagnosticPattern.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+		line_num, err := strconv.Atoi(matches[2])
+		if err != nil {
+			continue
+		}
+		column := 0
+		if matches[3] != "" {
+			column, _ = strconv.Atoi(matches[3])
+		}
+		result = append(result, &state.Diagnostic{
+			Column:  column,
+			File:    matches[1],
+			Line:    line_num,
+			Message: matches[4],
+			Source:  source,
+		})
+	}
+	return result
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Gleipnir-Technology/flogo/state"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []state.Diagnostic
+	}{
+		{
+			name:   "file line column",
+			output: "./main.go:10:5: unreachable code\n",
+			want:   []state.Diagnostic{{Column: 5, File: "./main.go", Line: 10, Message: "unreachable code"}},
+		},
+		{
+			name:   "no column",
+			output: "main.go:10: result of fmt.Sprintf call not used\n",
+			want:   []state.Diagnostic{{File: "main.go", Line: 10, Message: "result of fmt.Sprintf call not used"}},
+		},
+		{
+			name:   "colons in the message",
+			output: "main.go:1:2: fmt.Printf format %d has arg s of wrong type: string\n",
+			want:   []state.Diagnostic{{Column: 2, File: "main.go", Line: 1, Message: "fmt.Printf format %d has arg s of wrong type: string"}},
+		},
+		{
+			name:   "type error from go vet",
+			output: "# example.com/srv\nvet: ./main.go:4:2: undefined: x\n",
+			want:   []state.Diagnostic{{Column: 2, File: "./main.go", Line: 4, Message: "undefined: x"}},
+		},
+		{
+			name:   "windows path",
+			output: "C:\\src\\main.go:3:1: should have comment\r\n",
+			want:   []state.Diagnostic{{Column: 1, File: "C:\\src\\main.go", Line: 3, Message: "should have comment"}},
+		},
+		{
+			name: "several, among other output",
+			output: "# example.com/srv/lib\n" +
+				"\tlib/a.go:5:2: this value of err is never used (SA4006)\n" +
+				"lib/b.go:7:9: error strings should not be capitalized (ST1005)\n" +
+				"exit status 1\n",
+			want: []state.Diagnostic{
+				{Column: 2, File: "lib/a.go", Line: 5, Message: "this value of err is never used (SA4006)"},
+				{Column: 9, File: "lib/b.go", Line: 7, Message: "error strings should not be capitalized (ST1005)"},
+			},
+		},
+		{
+			name:   "nothing found",
+			output: "",
+			want:   []state.Diagnostic{},
+		},
+		{
+			name:   "not a diagnostic",
+			output: "main.go: no line\npanic: runtime error\nmain.go:1:2 no space after the colon\n",
+			want:   []state.Diagnostic{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseDiagnostics("go vet", []byte(tt.output))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d diagnostics, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i, want := range tt.want {
+				want.Source = "go vet"
+				if *got[i] != want {
+					t.Errorf("diagnostic %d is %+v, want %+v", i, *got[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestAnalyzerName(t *testing.T) {
+	tests := []struct {
+		command []string
+		want    string
+	}{
+		{[]string{"go", "vet", "./..."}, "go vet"},
+		{[]string{"/usr/local/bin/staticcheck", "./..."}, "staticcheck"},
+		{[]string{"go"}, "go"},
+	}
+	for _, tt := range tests {
+		if got := analyzerName(tt.command); got != tt.want {
+			t.Errorf("analyzerName(%q) is '%s', want '%s'", tt.command, got, tt.want)
+		}
+	}
+}
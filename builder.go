@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Gleipnir-Technology/flogo/process"
@@ -14,10 +22,13 @@ import (
 type EventBuilderType int
 
 const (
-	EventBuildFailure EventBuilderType = iota
+	// A build was abandoned because files changed while it was running
+	EventBuildCancelled EventBuilderType = iota
+	EventBuildFailure
 	EventBuildOutput
 	EventBuildStart
 	EventBuildSuccess
+	EventBuildUpToDate
 )
 
 type EventBuilder struct {
@@ -25,83 +36,453 @@ type EventBuilder struct {
 	Type    EventBuilderType
 }
 type Builder struct {
+	// Where each build is written before it is installed at Output. If empty the
+	// command is expected to write to Output itself.
+	CacheDir string
+	// Produces the program and arguments that build a binary at the given path
+	Command  func(output string) []string
 	Debounce time.Duration
-	OnEvent  chan<- EventBuilder
-	Target   string
-	ToBuild  <-chan string
+	// Hashes everything that goes into the build, so we can tell if the output
+	// is up to date. If nil the output is never considered up to date.
+	Fingerprint func() (string, error)
+	OnEvent     chan<- EventBuilder
+	// The absolute path of the binary that the runner uses
+	Output string
+	// Commands to run, in order, after a successful build. They get the path of
+	// the new binary in FLOGO_OUTPUT, before it is installed at Output.
+	PostBuild [][]string
+	// Commands to run, in order, before each build, like 'go generate ./...'
+	PreBuild [][]string
+	// The signals that stop a build step, in order, and how long to wait after each
+	StopSignals []syscall.Signal
+	StopTimeout time.Duration
+	Target      string
+	ToBuild     <-chan string
+
+	// Counts builds so each one gets a unique output
+	count int
+	// When the hooks of the latest build ran, so the files they write don't
+	// trigger another build
+	hookWindows []timeWindow
+	// The files that changed while the hooks of the latest build, and the one
+	// before it, were running
+	hookWrites     map[string]bool
+	prevHookWrites map[string]bool
+	mu             sync.Mutex
+	// Where the current build is writing its binary
+	staged string
+	// Gets the fingerprint of the sources the current build started from, once
+	// it is worked out
+	stagedFingerprint <-chan string
+	// Counts the builds that were installed, so a fingerprint that is slow to
+	// work out isn't written for a newer build
+	installed int
+	// Counts the changes to the sources, and how many there had been when the
+	// current build started. A fingerprint worked out alongside a build may
+	// include changes the build doesn't, so it's only written if there were none.
+	changes       int
+	stagedChanges int
+}
+
+// build is a build in progress: the hooks and the compiler, run one after another
+type build struct {
+	// The output of every step, and how much of the running step's is in it
+	copied  int
+	output  *process.Lines
+	process *process.Process
+	step    int
+	steps   []buildStep
+	sub     *process.Subscription[process.EventProcess]
+}
+type buildStep struct {
+	command []string
+	env     []string
+	// What the step is, for messages. Empty for the compiler itself.
+	hook string
+}
+type timeWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+// copyOutput adds the lines the running step printed since last time to the build's output
+func (bd *build) copyOutput() {
+	lines, next := bd.process.Output().Since(bd.copied)
+	for _, line := range lines {
+		bd.output.AppendLine(line)
+	}
+	bd.copied = next
+}
+
+// events gets the events of the step that is running, or nil if there isn't one
+func (bd *build) events() <-chan process.EventProcess {
+	if bd == nil || bd.sub == nil {
+		return nil
+	}
+	return bd.sub.C
 }
 
 func (b *Builder) Run(ctx context.Context) error {
 	logger := log.Ctx(ctx).With().Caller().Logger()
 
 	debounce := newDebounce(ctx, b.Debounce)
-	p := process.New("go", "build", ".")
-	p.SetDir(b.Target)
-	sub_event := p.OnEvent.Subscribe()
+	if b.CacheDir != "" {
+		err := b.prepareCacheDir()
+		if err != nil {
+			return err
+		}
+	}
+	chan_build := make(chan struct{})
+	var current *build
 	logger.Info().Msg("Started builder loop")
-	err := p.Start(ctx)
-	if err != nil {
-		logger.Warn().Err(err).Msg("failed to start builder process")
+	if b.isUpToDate(logger) {
+		logger.Info().Str("output", b.Output).Msg("build output is up to date, skipping initial build")
+		go b.onUpToDate(logger)
+	} else {
+		current = b.start(ctx, logger)
 	}
 	for {
 		select {
 		case <-ctx.Done():
 			logger.Info().Msg("Shutdown builder")
+			b.stop(current)
 			return nil
-		case evt := <-sub_event.C:
+		case evt := <-current.events():
 			logger.Info().Msg("builder sub event")
 			switch evt.Type {
 			case process.EventProcessStop:
-				go b.onExit(logger, p, evt.ProcessState)
+				b.onStepExit(ctx, logger, current, evt.ProcessState)
 			case process.EventProcessStart:
-				go b.onStart(logger)
 			case process.EventProcessOutput:
-				go b.onOutput(logger, p, evt.Data)
+				b.onOutput(logger, current, evt.Data)
 			default:
 				logger.Warn().Msg("unrecognized process event")
 			}
-		case <-b.ToBuild:
+		case path := <-b.ToBuild:
+			if b.writtenByHook(path) {
+				logger.Debug().Str("path", path).Msg("ignoring file written by a build hook")
+				continue
+			}
+			b.sourcesChanged()
 			debounce(func() {
-				p.Stop()
-				err := p.Start(ctx)
-				if err != nil {
-					logger.Error().Err(err).Msg("failed to start")
+				select {
+				case chan_build <- struct{}{}:
+				case <-ctx.Done():
 				}
 			})
+		case <-chan_build:
+			b.cancel(logger, current)
+			current = b.start(ctx, logger)
 		}
 	}
 }
 
-func (b *Builder) onOutput(logger zerolog.Logger, p *process.Process, buf []byte) {
+// isUpToDate checks if the output was built from the current sources
+func (b *Builder) isUpToDate(logger zerolog.Logger) bool {
+	if b.Fingerprint == nil {
+		return false
+	}
+	fingerprint, err := b.Fingerprint()
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to fingerprint build")
+		return false
+	}
+	return isUpToDate(b.Output, fingerprint)
+}
+
+// start begins a build into a fresh output
+func (b *Builder) start(ctx context.Context, logger zerolog.Logger) *build {
+	// Fingerprinting lists and hashes every source file, so it happens while
+	// the build runs rather than holding it up
+	fingerprint := make(chan string, 1)
+	if b.Fingerprint == nil {
+		fingerprint <- ""
+	} else {
+		go func() {
+			f, err := b.Fingerprint()
+			if err != nil {
+				logger.Debug().Err(err).Msg("failed to fingerprint build")
+			}
+			fingerprint <- f
+		}()
+	}
+	b.mu.Lock()
+	b.count++
+	output := b.Output
+	if b.CacheDir != "" {
+		output = filepath.Join(b.CacheDir, fmt.Sprintf("build-%d-%s", b.count, filepath.Base(b.Output)))
+	}
+	b.staged = output
+	b.stagedFingerprint = fingerprint
+	b.stagedChanges = b.changes
+	b.mu.Unlock()
+	b.hookWindows = b.hookWindows[:0]
+	b.prevHookWrites = b.hookWrites
+	b.hookWrites = make(map[string]bool)
+
+	steps := make([]buildStep, 0, len(b.PreBuild)+len(b.PostBuild)+1)
+	for _, c := range b.PreBuild {
+		steps = append(steps, buildStep{command: c, hook: "pre-build hook"})
+	}
+	steps = append(steps, buildStep{command: b.Command(output)})
+	for _, c := range b.PostBuild {
+		steps = append(steps, buildStep{
+			command: c,
+			env:     []string{"FLOGO_OUTPUT=" + output},
+			hook:    "post-build hook",
+		})
+	}
+	current := &build{
+		output: process.NewLines(process.DefaultCapacity),
+		steps:  steps,
+	}
+	b.onStart(logger)
+	b.startStep(ctx, logger, current)
+	return current
+}
+
+// startStep runs the current step of the build
+func (b *Builder) startStep(ctx context.Context, logger zerolog.Logger, bd *build) {
+	step := bd.steps[bd.step]
+	p := process.New(step.command[0], step.command[1:]...)
+	p.SetDir(b.Target)
+	p.SetEnv(step.env)
+	// The compiler and linker are children of 'go build', stopping the group
+	// stops them too
+	p.SetGroup(true)
+	p.SetStop(b.StopSignals, b.StopTimeout)
+	bd.copied = 0
+	bd.process = p
+	bd.sub = p.OnEvent.Subscribe()
+	if step.hook != "" {
+		b.hookWindows = append(b.hookWindows, timeWindow{start: time.Now()})
+	}
+	err := p.Start(ctx)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to start build step")
+		bd.sub.Close()
+		bd.sub = nil
+		bd.output.Append(process.StreamStderr, fmt.Appendf(nil, "flogo: %v", err))
+		b.finish(logger, bd, 1)
+	}
+}
+
+// stop abandons the build, if it is still going
+func (b *Builder) stop(bd *build) bool {
+	if bd == nil || bd.sub == nil {
+		return false
+	}
+	bd.sub.Close()
+	bd.sub = nil
+	bd.process.Stop()
+	return true
+}
+
+// cancel abandons the build, if it is still going, and reports that it was cancelled
+func (b *Builder) cancel(logger zerolog.Logger, bd *build) {
+	if !b.stop(bd) {
+		return
+	}
+	logger.Debug().Int("step", bd.step).Msg("cancelled build")
+	b.discard()
+	bd.copyOutput()
+	b.OnEvent <- EventBuilder{
+		Process: &state.Process{
+			ExitCode:   nil,
+			Output:     bd.output,
+			StopSignal: signalName(bd.process.StopSignal()),
+		},
+		Type: EventBuildCancelled,
+	}
+}
+
+// writtenByHook is true when a hook wrote the file, so a generator rewriting
+// its output doesn't cause an endless loop of builds. A file counts when it
+// was changed while a hook was running, and either says it is generated or
+// also changed while the hooks of the build before were running. Anything
+// else, like an edit saved while 'go generate' runs, still rebuilds.
+func (b *Builder) writtenByHook(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if !b.duringHook(info.ModTime()) {
+		return false
+	}
+	if b.hookWrites == nil {
+		b.hookWrites = make(map[string]bool)
+	}
+	b.hookWrites[path] = true
+	return b.prevHookWrites[path] || isGenerated(path)
+}
+
+// duringHook is true when the time falls while one of the latest build's hooks was running
+func (b *Builder) duringHook(t time.Time) bool {
+	for _, w := range b.hookWindows {
+		if t.Before(w.start) {
+			continue
+		}
+		if w.end.IsZero() || !t.After(w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pattern: the comment that marks generated files, see https://go.dev/s/generatedcode
+var generatedPattern = regexp.MustCompile(`(?m)^// Code generated .* DO NOT EDIT\.$`)
+
+// isGenerated is true when the start of the file says it was generated
+func isGenerated(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(f, head)
+	return generatedPattern.Match(bytes.ReplaceAll(head[:n], []byte("\r\n"), []byte("\n")))
+}
+
+// sourcesChanged notes that the sources changed, so the installed binary is
+// no longer up to date, even if flogo quits before the next build
+func (b *Builder) sourcesChanged() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.changes++
+	os.Remove(fingerprintPath(b.Output))
+}
+
+// install moves a successful build to where the runner expects it and
+// remembers what it was built from
+func (b *Builder) install() error {
+	b.mu.Lock()
+	staged := b.staged
+	fingerprint := b.stagedFingerprint
+	changes := b.stagedChanges
+	b.installed++
+	installed := b.installed
+	// Until we know what the new binary was built from, it isn't up to date
+	os.Remove(fingerprintPath(b.Output))
+	b.mu.Unlock()
+	if staged != b.Output {
+		err := installBinary(staged, b.Output)
+		if err != nil {
+			return err
+		}
+	}
+	go func() {
+		f := <-fingerprint
+		if f == "" {
+			return
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.installed != installed || b.changes != changes {
+			return
+		}
+		err := writeFingerprint(b.Output, f)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to write build fingerprint")
+		}
+	}()
+	return nil
+}
+
+// discard removes the output of a failed build, if there is any
+func (b *Builder) discard() {
+	b.mu.Lock()
+	staged := b.staged
+	b.mu.Unlock()
+	if staged == b.Output {
+		return
+	}
+	os.Remove(staged)
+}
+
+// prepareCacheDir makes sure the cache directory exists and clears out builds
+// left behind by a previous run
+func (b *Builder) prepareCacheDir() error {
+	err := os.MkdirAll(b.CacheDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create build cache '%s': %w", b.CacheDir, err)
+	}
+	stale, err := filepath.Glob(filepath.Join(b.CacheDir, "build-*"))
+	if err != nil {
+		return fmt.Errorf("Failed to list stale builds: %w", err)
+	}
+	for _, s := range stale {
+		os.Remove(s)
+	}
+	return nil
+}
+
+func (b *Builder) onOutput(logger zerolog.Logger, bd *build, buf []byte) {
 	logger.Debug().Bytes("b", buf).Msg("subprocess output")
+	bd.copyOutput()
 	b.OnEvent <- EventBuilder{
 		Process: &state.Process{
 			ExitCode: nil,
-			Output:   p.Output.Bytes(),
-			Stderr:   p.Stderr.Bytes(),
-			Stdout:   p.Stdout.Bytes(),
+			Output:   bd.output,
 		},
 		Type: EventBuildOutput,
 	}
 }
-func (b *Builder) onExit(logger zerolog.Logger, p *process.Process, s *os.ProcessState) {
-	var t EventBuilderType
+
+// onStepExit moves on to the next step of the build, or finishes it
+func (b *Builder) onStepExit(ctx context.Context, logger zerolog.Logger, bd *build, s *os.ProcessState) {
+	bd.sub.Close()
+	bd.sub = nil
+	step := bd.steps[bd.step]
+	if step.hook != "" {
+		b.hookWindows[len(b.hookWindows)-1].end = time.Now()
+	}
 	i := s.ExitCode()
+	bd.copyOutput()
+	if i != 0 {
+		if step.hook != "" {
+			bd.output.Append(process.StreamStderr, fmt.Appendf(nil, "flogo: %s '%s' failed with exit code %d", step.hook, strings.Join(step.command, " "), i))
+		}
+		b.finish(logger, bd, i)
+		return
+	}
+	bd.step++
+	if bd.step < len(bd.steps) {
+		b.startStep(ctx, logger, bd)
+		return
+	}
+	b.finish(logger, bd, i)
+}
+
+// finish installs the build if every step succeeded and reports how it went
+func (b *Builder) finish(logger zerolog.Logger, bd *build, i int) {
+	var t EventBuilderType
 	if i == 0 {
 		t = EventBuildSuccess
+		err := b.install()
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to install build")
+			t = EventBuildFailure
+			bd.output.Append(process.StreamStderr, fmt.Appendf(nil, "flogo: failed to install build: %v", err))
+		}
 	} else {
 		t = EventBuildFailure
+		b.discard()
 	}
 	b.OnEvent <- EventBuilder{
 		Process: &state.Process{
 			ExitCode: &i,
-			Output:   p.Output.Bytes(),
-			Stderr:   p.Stderr.Bytes(),
-			Stdout:   p.Stdout.Bytes(),
+			Output:   bd.output,
 		},
 		Type: t,
 	}
 }
+func (b *Builder) onUpToDate(logger zerolog.Logger) {
+	b.OnEvent <- EventBuilder{
+		Process: nil,
+		Type:    EventBuildUpToDate,
+	}
+}
 func (b *Builder) onStart(logger zerolog.Logger) {
 	b.OnEvent <- EventBuilder{
 		Process: nil,
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// buildCacheDir gets the directory flogo owns for building the project in target.
+// Each project gets its own directory so that several flogo instances don't collide.
+func buildCacheDir(target string) (string, error) {
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get abs path: %w", err)
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(abs))
+	name := filepath.Base(abs) + "-" + hex.EncodeToString(sum[:])[:12]
+	return filepath.Join(base, "flogo", name), nil
+}
+
+// installBinary moves the binary at src to dst, replacing whatever is there
+// without ever leaving a partially written file at dst. A process that is
+// running the old binary keeps running it.
+func installBinary(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	// Renaming doesn't work across filesystems, so copy next to the destination first
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*")
+	if err != nil {
+		return fmt.Errorf("Failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	err = copyFile(src, tmp)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to make '%s' executable: %w", tmp.Name(), err)
+	}
+	err = os.Rename(tmp.Name(), dst)
+	if err != nil {
+		return fmt.Errorf("Failed to rename '%s' to '%s': %w", tmp.Name(), dst, err)
+	}
+	os.Remove(src)
+	return nil
+}
+
+func copyFile(src string, dst io.Writer) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Failed to open '%s': %w", src, err)
+	}
+	defer f.Close()
+	_, err = io.Copy(dst, f)
+	if err != nil {
+		return fmt.Errorf("Failed to copy '%s': %w", src, err)
+	}
+	return nil
+}
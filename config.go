@@ -0,0 +1,677 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Gleipnir-Technology/flogo/process"
+)
+
+// The name of the optional per-project configuration file, looked for in the target directory
+const configFilename = "flogo.toml"
+
+// Config holds everything that can be configured about flogo.
+// Each value comes from, in order of precedence, a command-line flag, an
+// environment variable, the project's flogo.toml, or the default.
+type Config struct {
+	// The address for the proxy webserver to listen on
+	Bind string `toml:"bind"`
+	// How long to wait after the last change before building
+	Debounce time.Duration `toml:"debounce"`
+	// The type of UI to show, either "tcell" or "flat"
+	UI string `toml:"ui"`
+	// The URL where the program being built serves HTTP
+	Upstream string `toml:"upstream"`
+	// Whether to write debug logs
+	Verbose bool `toml:"verbose"`
+
+	Analyze ConfigAnalyze `toml:"analyze"`
+	Build   ConfigBuild   `toml:"build"`
+	Run     ConfigRun     `toml:"run"`
+	Test    ConfigTest    `toml:"test"`
+	Watch   ConfigWatch   `toml:"watch"`
+
+	// The directory containing the go project to build
+	Target string `toml:"-"`
+	// The parsed form of Upstream
+	UpstreamURL *url.URL `toml:"-"`
+	// The parsed form of Run.AlternateUpstream
+	AlternateUpstreamURL *url.URL `toml:"-"`
+
+	// The absolute path of the binary the build produces
+	buildOutput string
+	// Where flogo keeps its builds of this project
+	cacheDir string
+}
+type ConfigAnalyze struct {
+	// The analyzers to run after each successful build. Each prints problems
+	// as 'file:line:col: message'. Defaults to 'go vet ./...'.
+	Commands [][]string `toml:"commands"`
+	// Whether to run the analyzers
+	Enabled bool `toml:"enabled"`
+}
+type ConfigBuild struct {
+	// Extra arguments to 'go build', like "-race" or "-trimpath"
+	Args []string `toml:"args"`
+	// A command to run instead of 'go build'. It must write the binary to Output.
+	Command []string `toml:"command"`
+	// Passed to 'go build -gcflags', for example "all=-N -l"
+	GCFlags string `toml:"gcflags"`
+	// Passed to 'go build -ldflags', for example "-X main.version=dev"
+	LDFlags string `toml:"ldflags"`
+	// Where to put the binary, relative to the target. Defaults to the name
+	// 'go build' would use, in flogo's cache directory.
+	Output string `toml:"output"`
+	// The package to build, relative to the target, like "./cmd/server"
+	Package string `toml:"package"`
+	// Commands to run, in order, after each successful build. They get the
+	// path of the new binary in FLOGO_OUTPUT.
+	Post [][]string `toml:"post"`
+	// Commands to run, in order, before each build, like ["go", "generate", "./..."]
+	Pre [][]string `toml:"pre"`
+	// How to stop a build that is no longer needed
+	Stop ConfigStop `toml:"stop"`
+	// Build tags, passed to 'go build -tags'
+	Tags []string `toml:"tags"`
+}
+type ConfigRun struct {
+	// Arguments to pass to the built program. Anything after '--' on the
+	// command line replaces these.
+	Args []string `toml:"args"`
+	// Environment variables to set for the built program. These take
+	// precedence over the ones in EnvFile.
+	Env map[string]string `toml:"env"`
+	// A file of KEY=value lines, relative to the target, to add to the
+	// environment of the built program. Empty to disable.
+	EnvFile string `toml:"env_file"`
+	// How to replace the program after a build. "restart" stops the old one
+	// before starting the new one. "bluegreen" starts the new one on
+	// AlternateUpstream, switches the proxy once it is ready, then stops the
+	// old one.
+	Mode string `toml:"mode"`
+	// How many lines of the program's output to keep. Older lines are dropped.
+	OutputLines int `toml:"output_lines"`
+	// Where the program listens every other restart in bluegreen mode.
+	// Defaults to the upstream with the next port number.
+	AlternateUpstream string `toml:"alternate_upstream"`
+	// The environment variable that tells the program which port to listen
+	// on in bluegreen mode
+	PortEnv string `toml:"port_env"`
+
+	Ready ConfigReady `toml:"ready"`
+	// How to stop the program before starting the new one
+	Stop ConfigStop `toml:"stop"`
+}
+type ConfigReady struct {
+	// An HTTP path that responds with a status below 500 once the program is
+	// ready. If empty the program is ready once it accepts connections.
+	Path string `toml:"path"`
+	// How long to wait for the program to be ready
+	Timeout time.Duration `toml:"timeout"`
+}
+type ConfigStop struct {
+	// The signals to send, in order, like ["SIGTERM", "SIGKILL"]. Each is sent
+	// if the process is still running Timeout after the one before. If it is
+	// still running after the last one, it is killed.
+	Signals []string `toml:"signals"`
+	// How long to wait for the process to exit after each signal
+	Timeout time.Duration `toml:"timeout"`
+}
+type ConfigTest struct {
+	// Extra arguments to 'go test', like "-race" or "-short"
+	Args []string `toml:"args"`
+	// Whether to run the tests of the packages affected by each change
+	Enabled bool `toml:"enabled"`
+	// How to stop tests that a newer change has made out of date
+	Stop ConfigStop `toml:"stop"`
+}
+type ConfigWatch struct {
+	// Glob patterns for paths that should never be watched
+	Exclude []string `toml:"exclude"`
+	// What to do when a file with a given extension changes: "rebuild",
+	// "asset" or "ignore". These are added to the defaults.
+	Extensions map[string]string `toml:"extensions"`
+	// Whether to skip the paths that git ignores
+	Gitignore bool `toml:"gitignore"`
+	// Glob patterns for files that should trigger a rebuild
+	Include []string `toml:"include"`
+	// How to find out about changes: "notify" uses the operating system's
+	// notifications, "poll" checks the files every PollInterval, and "auto"
+	// notifies until the operating system runs out of notifications, then polls.
+	Mode string `toml:"mode"`
+	// How often to check the files when polling
+	PollInterval time.Duration `toml:"poll_interval"`
+	// Whether changes to _test.go files trigger a rebuild
+	Tests bool `toml:"tests"`
+}
+
+// configFlags are the command-line flags that can override the configuration
+type configFlags struct {
+	bind     *string
+	debounce *time.Duration
+	target   *string
+	ui       *string
+	upstream *string
+	verbose  *bool
+}
+
+func defaultConfig() Config {
+	return Config{
+		Bind:     ":10000",
+		Debounce: time.Millisecond * 300,
+		UI:       "tcell",
+		Upstream: "http://localhost:9001",
+		Verbose:  false,
+		Analyze: ConfigAnalyze{
+			Commands: [][]string{},
+			Enabled:  false,
+		},
+		Build: ConfigBuild{
+			Args:    []string{},
+			Command: []string{},
+			Package: ".",
+			Post:    [][]string{},
+			Pre:     [][]string{},
+			Stop: ConfigStop{
+				// There's nothing in a half-finished build worth saving
+				Signals: []string{"SIGKILL"},
+				Timeout: process.DefaultStopTimeout,
+			},
+			Tags: []string{},
+		},
+		Run: ConfigRun{
+			Args:        []string{},
+			Env:         map[string]string{},
+			EnvFile:     ".env",
+			Mode:        "restart",
+			OutputLines: process.DefaultCapacity,
+			PortEnv:     "PORT",
+			Ready: ConfigReady{
+				Path:    "",
+				Timeout: time.Second * 30,
+			},
+			Stop: ConfigStop{
+				Signals: []string{"SIGINT", "SIGKILL"},
+				Timeout: process.DefaultStopTimeout,
+			},
+		},
+		Test: ConfigTest{
+			Args:    []string{},
+			Enabled: false,
+			Stop: ConfigStop{
+				Signals: []string{"SIGINT", "SIGKILL"},
+				Timeout: process.DefaultStopTimeout,
+			},
+		},
+		Watch: ConfigWatch{
+			Exclude: []string{},
+			Extensions: map[string]string{
+				".css":  "asset",
+				".gif":  "asset",
+				".go":   "rebuild",
+				".ico":  "asset",
+				".jpeg": "asset",
+				".jpg":  "asset",
+				".png":  "asset",
+				".svg":  "asset",
+				".webp": "asset",
+			},
+			Gitignore:    true,
+			Include:      []string{},
+			Mode:         "auto",
+			PollInterval: time.Millisecond * 500,
+			Tests:        false,
+		},
+		Target: ".",
+	}
+}
+
+func newConfigFlags(fs *flag.FlagSet) configFlags {
+	d := defaultConfig()
+	return configFlags{
+		bind:     fs.String("bind", d.Bind, "The address for the proxy webserver to listen on"),
+		debounce: fs.Duration("debounce", d.Debounce, "How long to wait after a change before building"),
+		target:   fs.String("target", d.Target, "The directory containing the go project to build"),
+		ui:       fs.String("ui", d.UI, "The type of UI to show, 'tcell' or 'flat'"),
+		upstream: fs.String("upstream", d.Upstream, "The URL where the program being built serves HTTP"),
+		verbose:  fs.Bool("verbose", d.Verbose, "Write debug logs"),
+	}
+}
+
+// loadConfig builds the configuration from the defaults, the flogo.toml in the
+// target directory, the environment and the flags that were set on fs.
+func loadConfig(fs *flag.FlagSet, flags configFlags) (*Config, error) {
+	cfg := defaultConfig()
+	cfg.Target = *flags.target
+
+	err := cfg.loadFile(filepath.Join(cfg.Target, configFilename))
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.loadEnv()
+	if err != nil {
+		return nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "bind":
+			cfg.Bind = *flags.bind
+		case "debounce":
+			cfg.Debounce = *flags.debounce
+		case "ui":
+			cfg.UI = *flags.ui
+		case "upstream":
+			cfg.Upstream = *flags.upstream
+		case "verbose":
+			cfg.Verbose = *flags.verbose
+		}
+	})
+	// Everything after '--' is for the built program
+	if fs.NArg() > 0 {
+		cfg.Run.Args = fs.Args()
+	}
+	err = cfg.loadEnvFile()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.resolveBuild()
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// loadFile overlays the values in the file at path, if it exists
+func (cfg *Config) loadFile(path string) error {
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("Failed to parse '%s': %w", path, err)
+	}
+	undecoded := md.Undecoded()
+	if len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		return fmt.Errorf("Unrecognized keys in '%s': %s", path, strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// loadEnv overlays the values from FLOGO_* environment variables that are set
+func (cfg *Config) loadEnv() error {
+	if v := os.Getenv("FLOGO_BIND"); v != "" {
+		cfg.Bind = v
+	}
+	if v := os.Getenv("FLOGO_DEBOUNCE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("Failed to parse FLOGO_DEBOUNCE '%s': %w", v, err)
+		}
+		cfg.Debounce = d
+	}
+	if v := os.Getenv("FLOGO_UI"); v != "" {
+		cfg.UI = v
+	}
+	if v := os.Getenv("FLOGO_UPSTREAM"); v != "" {
+		cfg.Upstream = v
+	}
+	if v := os.Getenv("FLOGO_VERBOSE"); v != "" {
+		cfg.Verbose = true
+	}
+	return nil
+}
+
+// loadEnvFile adds the variables from the run env file that aren't already set in the run env
+func (cfg *Config) loadEnvFile() error {
+	if cfg.Run.EnvFile == "" {
+		return nil
+	}
+	path := cfg.Run.EnvFile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cfg.Target, path)
+	}
+	env, err := loadDotEnv(path)
+	if err != nil {
+		return err
+	}
+	if cfg.Run.Env == nil {
+		cfg.Run.Env = make(map[string]string, len(env))
+	}
+	for k, v := range env {
+		if _, ok := cfg.Run.Env[k]; !ok {
+			cfg.Run.Env[k] = v
+		}
+	}
+	return nil
+}
+
+// validate checks the final configuration and fills in the parsed values
+func (cfg *Config) validate() error {
+	errs := make([]error, 0)
+	if _, _, err := net.SplitHostPort(cfg.Bind); err != nil {
+		errs = append(errs, fmt.Errorf("bind '%s' is not a valid address: %w", cfg.Bind, err))
+	}
+	if cfg.Debounce < 0 {
+		errs = append(errs, fmt.Errorf("debounce '%s' can't be negative", cfg.Debounce))
+	}
+	switch cfg.UI {
+	case "tcell", "flat":
+	default:
+		errs = append(errs, fmt.Errorf("ui '%s' is not one of 'tcell' or 'flat'", cfg.UI))
+	}
+	u, err := url.Parse(cfg.Upstream)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("upstream '%s' is not a valid URL: %w", cfg.Upstream, err))
+	} else if u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("upstream '%s' needs a scheme and host", cfg.Upstream))
+	} else {
+		cfg.UpstreamURL = u
+	}
+	switch cfg.Run.Mode {
+	case "restart":
+	case "bluegreen":
+		if cfg.UpstreamURL != nil {
+			a, err := cfg.alternateUpstream()
+			if err != nil {
+				errs = append(errs, err)
+			} else {
+				cfg.AlternateUpstreamURL = a
+			}
+		}
+		if cfg.Run.PortEnv == "" {
+			errs = append(errs, fmt.Errorf("run.port_env is required for bluegreen mode"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("run.mode '%s' is not one of 'restart' or 'bluegreen'", cfg.Run.Mode))
+	}
+	if cfg.Run.OutputLines <= 0 {
+		errs = append(errs, fmt.Errorf("run.output_lines must be positive"))
+	}
+	if cfg.Run.Ready.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("run.ready.timeout must be positive"))
+	}
+	for _, patterns := range [][]string{cfg.Watch.Exclude, cfg.Watch.Include} {
+		for _, pattern := range patterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("watch pattern '%s' is invalid: %w", pattern, err))
+			}
+		}
+	}
+	for ext, action := range cfg.Watch.Extensions {
+		if !strings.HasPrefix(ext, ".") {
+			errs = append(errs, fmt.Errorf("watch.extensions '%s' should start with '.'", ext))
+		}
+		if _, err := ParseWatchAction(action); err != nil {
+			errs = append(errs, fmt.Errorf("watch.extensions '%s': %w", ext, err))
+		}
+	}
+	if _, err := ParseWatchMode(cfg.Watch.Mode); err != nil {
+		errs = append(errs, fmt.Errorf("watch.mode: %w", err))
+	}
+	if cfg.Watch.PollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("watch.poll_interval must be positive"))
+	}
+	if len(cfg.Build.Command) > 0 && cfg.Build.Output == "" {
+		errs = append(errs, fmt.Errorf("build.output is required when using build.command"))
+	}
+	for _, command := range cfg.Analyze.Commands {
+		if len(command) == 0 || command[0] == "" {
+			errs = append(errs, fmt.Errorf("analyze.commands can't be empty"))
+		}
+	}
+	for _, hooks := range [][][]string{cfg.Build.Pre, cfg.Build.Post} {
+		for _, hook := range hooks {
+			if len(hook) == 0 || hook[0] == "" {
+				errs = append(errs, fmt.Errorf("build.pre and build.post commands can't be empty"))
+			}
+		}
+	}
+	errs = append(errs, cfg.Build.Stop.validate("build.stop")...)
+	errs = append(errs, cfg.Run.Stop.validate("run.stop")...)
+	errs = append(errs, cfg.Test.Stop.validate("test.stop")...)
+	if cfg.Build.Package == "" {
+		errs = append(errs, fmt.Errorf("build.package can't be empty"))
+	}
+	if info, err := os.Stat(cfg.Target); err != nil {
+		errs = append(errs, fmt.Errorf("target '%s' is not usable: %w", cfg.Target, err))
+	} else if !info.IsDir() {
+		errs = append(errs, fmt.Errorf("target '%s' is not a directory", cfg.Target))
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks the stop signals and timeout, which are under key in the file
+func (c ConfigStop) validate(key string) []error {
+	errs := make([]error, 0)
+	if len(c.Signals) == 0 {
+		errs = append(errs, fmt.Errorf("%s.signals can't be empty", key))
+	}
+	for _, name := range c.Signals {
+		if _, err := process.ParseSignal(name); err != nil {
+			errs = append(errs, fmt.Errorf("%s.signals: %w", key, err))
+		}
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("%s.timeout must be positive", key))
+	}
+	return errs
+}
+
+// ParsedSignals gets the signals to stop a process with
+func (c ConfigStop) ParsedSignals() []syscall.Signal {
+	result := make([]syscall.Signal, 0, len(c.Signals))
+	for _, name := range c.Signals {
+		// Already checked by validate
+		s, _ := process.ParseSignal(name)
+		result = append(result, s)
+	}
+	return result
+}
+
+// alternateUpstream parses the alternate upstream, or makes one from the upstream
+func (cfg *Config) alternateUpstream() (*url.URL, error) {
+	if cfg.Run.AlternateUpstream == "" {
+		port, err := strconv.Atoi(upstreamPort(*cfg.UpstreamURL))
+		if err != nil {
+			return nil, fmt.Errorf("can't determine the port of upstream '%s': %w", cfg.Upstream, err)
+		}
+		result := *cfg.UpstreamURL
+		result.Host = net.JoinHostPort(cfg.UpstreamURL.Hostname(), strconv.Itoa(port+1))
+		return &result, nil
+	}
+	a, err := url.Parse(cfg.Run.AlternateUpstream)
+	if err != nil {
+		return nil, fmt.Errorf("run.alternate_upstream '%s' is not a valid URL: %w", cfg.Run.AlternateUpstream, err)
+	}
+	if a.Scheme == "" || a.Host == "" {
+		return nil, fmt.Errorf("run.alternate_upstream '%s' needs a scheme and host", cfg.Run.AlternateUpstream)
+	}
+	if upstreamAddress(*a) == upstreamAddress(*cfg.UpstreamURL) {
+		return nil, fmt.Errorf("run.alternate_upstream '%s' must be different from upstream", cfg.Run.AlternateUpstream)
+	}
+	return a, nil
+}
+
+// WatchExtensions gets what to do when a file with a given extension changes
+func (cfg *Config) WatchExtensions() map[string]WatchAction {
+	result := make(map[string]WatchAction, len(cfg.Watch.Extensions))
+	for ext, action := range cfg.Watch.Extensions {
+		// Already checked by validate
+		a, _ := ParseWatchAction(action)
+		result[strings.ToLower(ext)] = a
+	}
+	return result
+}
+
+// BuildSources lists the files that go into the binary. It is nil when we
+// can't tell because a custom build command is used.
+func (cfg *Config) BuildSources() (*buildSources, error) {
+	if len(cfg.Build.Command) > 0 {
+		return nil, nil
+	}
+	result := newBuildSources(cfg.Target, cfg.Build.Package, cfg.Build.Tags)
+	err := result.Refresh()
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// LocalDependencies finds the directories of local modules outside the target that the build uses
+func (cfg *Config) LocalDependencies() ([]string, error) {
+	if len(cfg.Build.Command) > 0 {
+		return []string{}, nil
+	}
+	return localDependencies(cfg.Target)
+}
+
+// NewWatcher creates a watcher for the configured target
+func (cfg *Config) NewWatcher(on_event chan<- EventWatcher) (*Watcher, error) {
+	sources, err := cfg.BuildSources()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find the files in the build: %w", err)
+	}
+	dependencies, err := cfg.LocalDependencies()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find local dependencies: %w", err)
+	}
+	// Already checked by validate
+	mode, _ := ParseWatchMode(cfg.Watch.Mode)
+	return &Watcher{
+		Dependencies: dependencies,
+		Exclude:      cfg.Watch.Exclude,
+		Extensions:   cfg.WatchExtensions(),
+		Gitignore:    cfg.Watch.Gitignore,
+		Include:      cfg.Watch.Include,
+		Mode:         mode,
+		OnEvent:      on_event,
+		PollInterval: cfg.Watch.PollInterval,
+		RunTests:     cfg.Test.Enabled,
+		Sources:      sources,
+		Target:       cfg.Target,
+		Tests:        cfg.Watch.Tests,
+	}, nil
+}
+
+// RunnerMode gets the way the runner replaces the program
+func (cfg *Config) RunnerMode() RunnerMode {
+	if cfg.Run.Mode == "bluegreen" {
+		return RunnerModeBlueGreen
+	}
+	return RunnerModeRestart
+}
+
+// RunEnv gets the extra environment for the built program in "KEY=value" form
+func (cfg *Config) RunEnv() []string {
+	result := make([]string, 0, len(cfg.Run.Env))
+	for k, v := range cfg.Run.Env {
+		result = append(result, k+"="+v)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// BuildOutputAbs gets the absolute path of the binary the build produces
+func (cfg *Config) BuildOutputAbs() string {
+	return cfg.buildOutput
+}
+
+// BuildCacheDir gets the directory builds are written to before they are
+// installed, or an empty string if the build writes the output directly
+func (cfg *Config) BuildCacheDir() string {
+	if len(cfg.Build.Command) > 0 {
+		return ""
+	}
+	return cfg.cacheDir
+}
+
+// resolveBuild picks the main package to build and where the binary goes
+func (cfg *Config) resolveBuild() error {
+	abs, err := filepath.Abs(cfg.Target)
+	if err != nil {
+		return fmt.Errorf("Failed to get abs path: %w", err)
+	}
+	// A custom build command may not be building a go package at all
+	if len(cfg.Build.Command) > 0 {
+		cfg.buildOutput = filepath.Join(abs, cfg.Build.Output)
+		return nil
+	}
+	pkg, err := findMainPackage(cfg.Target, cfg.Build.Package)
+	if err != nil {
+		return fmt.Errorf("Failed to determine the package to build: %w", err)
+	}
+	cfg.Build.Package = relativePackage(cfg.Target, pkg.Dir)
+	cfg.cacheDir, err = buildCacheDir(cfg.Target)
+	if err != nil {
+		return fmt.Errorf("Failed to determine build cache: %w", err)
+	}
+	if cfg.Build.Output != "" {
+		cfg.buildOutput = filepath.Join(abs, cfg.Build.Output)
+	} else {
+		// Keep the binary out of the source tree
+		cfg.buildOutput = filepath.Join(cfg.cacheDir, binaryName(pkg))
+	}
+	return nil
+}
+
+// BuildFingerprint hashes everything that goes into the build
+func (cfg *Config) BuildFingerprint() (string, error) {
+	command := cfg.BuildCommand("output")
+	// Post-build hooks can change the binary
+	for _, hook := range cfg.Build.Post {
+		command = append(command, "&&")
+		command = append(command, hook...)
+	}
+	return buildFingerprint(cfg.Target, cfg.Build.Package, cfg.Build.Tags, command)
+}
+
+// AnalyzeCommands gets the analyzers to run after each successful build
+func (cfg *Config) AnalyzeCommands() [][]string {
+	if len(cfg.Analyze.Commands) > 0 {
+		return cfg.Analyze.Commands
+	}
+	vet := []string{"go", "vet"}
+	if len(cfg.Build.Tags) > 0 {
+		vet = append(vet, "-tags", strings.Join(cfg.Build.Tags, ","))
+	}
+	return [][]string{append(vet, "./...")}
+}
+
+// BuildCommand gets the full command line to build the binary at output
+func (cfg *Config) BuildCommand(output string) []string {
+	if len(cfg.Build.Command) > 0 {
+		return cfg.Build.Command
+	}
+	result := []string{"go", "build"}
+	if len(cfg.Build.Tags) > 0 {
+		result = append(result, "-tags", strings.Join(cfg.Build.Tags, ","))
+	}
+	if cfg.Build.GCFlags != "" {
+		result = append(result, "-gcflags", cfg.Build.GCFlags)
+	}
+	if cfg.Build.LDFlags != "" {
+		result = append(result, "-ldflags", cfg.Build.LDFlags)
+	}
+	result = append(result, cfg.Build.Args...)
+	result = append(result, "-o", output, cfg.Build.Package)
+	return result
+}
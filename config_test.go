@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		// The top of flogo.toml, which gets a build command so go list isn't needed
+		file         string
+		env          map[string]string
+		args         []string
+		wantBind     string
+		wantDebounce time.Duration
+		wantUI       string
+	}{
+		{
+			name:         "defaults",
+			wantBind:     ":10000",
+			wantDebounce: 300 * time.Millisecond,
+			wantUI:       "tcell",
+		},
+		{
+			name:         "file over default",
+			file:         "bind = \":1\"\ndebounce = \"1s\"\nui = \"flat\"\n",
+			wantBind:     ":1",
+			wantDebounce: time.Second,
+			wantUI:       "flat",
+		},
+		{
+			name:         "env over file",
+			file:         "bind = \":1\"\ndebounce = \"1s\"\n",
+			env:          map[string]string{"FLOGO_BIND": ":2", "FLOGO_DEBOUNCE": "2s"},
+			wantBind:     ":2",
+			wantDebounce: 2 * time.Second,
+			wantUI:       "tcell",
+		},
+		{
+			name:         "flag over env",
+			file:         "bind = \":1\"\n",
+			env:          map[string]string{"FLOGO_BIND": ":2", "FLOGO_UI": "flat"},
+			args:         []string{"-bind", ":3", "-ui", "tcell"},
+			wantBind:     ":3",
+			wantDebounce: 300 * time.Millisecond,
+			wantUI:       "tcell",
+		},
+		{
+			name:         "flag set to its default still wins",
+			file:         "bind = \":1\"\ndebounce = \"1s\"\n",
+			args:         []string{"-bind", ":10000"},
+			wantBind:     ":10000",
+			wantDebounce: time.Second,
+			wantUI:       "tcell",
+		},
+		{
+			name:         "each setting on its own",
+			file:         "debounce = \"1s\"\n",
+			env:          map[string]string{"FLOGO_UI": "flat"},
+			args:         []string{"-bind", ":3"},
+			wantBind:     ":3",
+			wantDebounce: time.Second,
+			wantUI:       "flat",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, tt.file, tt.env, tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Bind != tt.wantBind {
+				t.Errorf("bind is '%s', want '%s'", cfg.Bind, tt.wantBind)
+			}
+			if cfg.Debounce != tt.wantDebounce {
+				t.Errorf("debounce is %s, want %s", cfg.Debounce, tt.wantDebounce)
+			}
+			if cfg.UI != tt.wantUI {
+				t.Errorf("ui is '%s', want '%s'", cfg.UI, tt.wantUI)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+	}{
+		{"unknown key", "colour = \"blue\"\n", nil},
+		{"bad env duration", "", map[string]string{"FLOGO_DEBOUNCE": "soon"}},
+		{"bad file value", "ui = \"web\"\n", nil},
+		{"bad env value", "", map[string]string{"FLOGO_BIND": "nowhere"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadTestConfig(t, tt.file, tt.env, nil); err == nil {
+				t.Error("loading the configuration should fail")
+			}
+		})
+	}
+}
+
+// loadTestConfig loads the configuration for a target with the file, the
+// environment and the command line arguments
+func loadTestConfig(t *testing.T, file string, env map[string]string, args []string) (*Config, error) {
+	t.Helper()
+	target := t.TempDir()
+	// Top level keys have to come before the first table
+	content := file + "[build]\ncommand = [\"true\"]\noutput = \"app\"\n"
+	err := os.WriteFile(filepath.Join(target, configFilename), []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"FLOGO_BIND", "FLOGO_DEBOUNCE", "FLOGO_UI", "FLOGO_UPSTREAM", "FLOGO_VERBOSE"} {
+		t.Setenv(name, env[name])
+	}
+	fs := flag.NewFlagSet("flogo", flag.ContinueOnError)
+	flags := newConfigFlags(fs)
+	err = fs.Parse(append([]string{"-target", target}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(fs, flags)
+}
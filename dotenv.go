@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// loadDotEnv reads a file of KEY=value lines, as used by many tools as '.env'.
+// Values can refer to variables defined earlier in the file, or in flogo's own
+// environment, with $VAR or ${VAR}. A file that doesn't exist is not an error.
+func loadDotEnv(path string) (map[string]string, error) {
+	result := make(map[string]string)
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return result, nil
+		}
+		return nil, fmt.Errorf("Failed to open '%s': %w", path, err)
+	}
+	defer f.Close()
+
+	lookup := func(key string) string {
+		if v, ok := result[key]; ok {
+			return v
+		}
+		return os.Getenv(key)
+	}
+	scanner := bufio.NewScanner(f)
+	line_num := 0
+	for scanner.Scan() {
+		line_num++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, line_num)
+		}
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("%s:%d: missing variable name", path, line_num)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			// Single quotes are literal
+			result[key] = value[1 : len(value)-1]
+			continue
+		}
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+			value = strings.ReplaceAll(value, `\n`, "\n")
+			value = strings.ReplaceAll(value, `\"`, `"`)
+		} else if idx := strings.Index(value, " #"); idx >= 0 {
+			// Unquoted values can have trailing comments
+			value = strings.TrimSpace(value[:idx])
+		}
+		result[key] = os.Expand(value, lookup)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read '%s': %w", path, err)
+	}
+	return result, nil
+}
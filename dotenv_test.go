@@ -0,0 +1,82 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDotEnv(t *testing.T) {
+	t.Setenv("FLOGO_TEST_HOME", "/home/test")
+	t.Setenv("FLOGO_TEST_UNSET", "")
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{"plain", "A=1\nB=two words\n", map[string]string{"A": "1", "B": "two words"}},
+		{"spaces around", "  A = 1  \n", map[string]string{"A": "1"}},
+		{"comments and blank lines", "# comment\n\nA=1\n", map[string]string{"A": "1"}},
+		{"export", "export A=1\n", map[string]string{"A": "1"}},
+		{"trailing comment", "A=1 # the first\n", map[string]string{"A": "1"}},
+		{"hash without a space", "A=a#b\n", map[string]string{"A": "a#b"}},
+		{"equals in value", "A=b=c\n", map[string]string{"A": "b=c"}},
+		{"empty value", "A=\n", map[string]string{"A": ""}},
+		{"double quotes", `A="  padded # not a comment  "`, map[string]string{"A": "  padded # not a comment  "}},
+		{"double quote escapes", `A="line\nnext \"quoted\""`, map[string]string{"A": "line\nnext \"quoted\""}},
+		{"single quotes", `A='  $HOME\n # "as is"  '`, map[string]string{"A": `  $HOME\n # "as is"  `}},
+		{"unmatched quote", `A="open`, map[string]string{"A": `"open`}},
+		{"earlier variable", "A=1\nB=${A}2\nC=$A-3\n", map[string]string{"A": "1", "B": "12", "C": "1-3"}},
+		{"earlier variable in double quotes", "A=1\nB=\"${A} 2\"\n", map[string]string{"A": "1", "B": "1 2"}},
+		{"environment", "A=${FLOGO_TEST_HOME}/bin\n", map[string]string{"A": "/home/test/bin"}},
+		{"file over environment", "FLOGO_TEST_HOME=/srv\nA=$FLOGO_TEST_HOME\n", map[string]string{"FLOGO_TEST_HOME": "/srv", "A": "/srv"}},
+		{"later variable", "A=${B}\nB=1\n", map[string]string{"A": "", "B": "1"}},
+		{"unset variable", "A=x${FLOGO_TEST_UNSET}y\n", map[string]string{"A": "xy"}},
+		{"redefined", "A=1\nA=${A}2\n", map[string]string{"A": "12"}},
+		{"crlf", "A=1\r\nB='2'\r\n", map[string]string{"A": "1", "B": "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".env")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadDotEnv(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDotEnvErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"no equals", "A=1\nJUST_A_NAME\n"},
+		{"no name", "=1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".env")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadDotEnv(path); err == nil {
+				t.Error("loading the file should fail")
+			}
+		})
+	}
+}
+
+func TestLoadDotEnvMissing(t *testing.T) {
+	got, err := loadDotEnv(filepath.Join(t.TempDir(), ".env"))
+	if err != nil || len(got) != 0 {
+		t.Errorf("missing file got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// buildFingerprint hashes everything that determines the binary 'go build'
+// produces: the build command, the toolchain, the local source files of every
+// package the main package depends on, and the versions of the modules that
+// provide the rest.
+func buildFingerprint(target string, pkg string, tags []string, command []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "command %s\n", strings.Join(command, "\x00"))
+
+	goenv := exec.Command("go", "env", "GOVERSION", "GOOS", "GOARCH", "CGO_ENABLED", "GOFLAGS", "GOEXPERIMENT")
+	goenv.Dir = target
+	env, err := goenv.Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to run 'go env': %w", err)
+	}
+	fmt.Fprintf(h, "env %s\n", env)
+
+	args := []string{"-deps"}
+	if len(tags) > 0 {
+		args = append(args, "-tags", strings.Join(tags, ","))
+	}
+	packages, err := goList(target, append(args, pkg)...)
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		return packages[i].ImportPath < packages[j].ImportPath
+	})
+	go_mods := make(map[string]bool)
+	for _, p := range packages {
+		if p.Error != nil {
+			return "", fmt.Errorf("package '%s' has errors: %s", p.ImportPath, p.Error.Err)
+		}
+		if p.Standard {
+			continue
+		}
+		if !p.IsLocal() {
+			fmt.Fprintf(h, "module %s@%s\n", p.Module.Path, p.Module.Version)
+			continue
+		}
+		if p.Module != nil && p.Module.GoMod != "" {
+			go_mods[p.Module.GoMod] = true
+		}
+		fmt.Fprintf(h, "package %s\n", p.ImportPath)
+		for _, f := range p.SourceFiles() {
+			err := hashFile(h, f)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	// go.sum lives next to go.mod and pins the versions of everything else
+	mods := make([]string, 0, len(go_mods))
+	for m := range go_mods {
+		mods = append(mods, m)
+	}
+	sort.Strings(mods)
+	for _, m := range mods {
+		for _, f := range []string{m, strings.TrimSuffix(m, ".mod") + ".sum"} {
+			err := hashFile(h, f)
+			if err != nil && !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(h io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintf(h, "file %s\n", path)
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("Failed to read '%s': %w", path, err)
+	}
+	return nil
+}
+
+// fingerprintPath is where we remember the fingerprint of the binary at output
+func fingerprintPath(output string) string {
+	return output + ".flogo-fingerprint"
+}
+
+// isUpToDate checks that the binary at output exists and was built from the fingerprinted sources
+func isUpToDate(output string, fingerprint string) bool {
+	if _, err := os.Stat(output); err != nil {
+		return false
+	}
+	previous, err := os.ReadFile(fingerprintPath(output))
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(previous)) == fingerprint
+}
+
+func writeFingerprint(output string, fingerprint string) error {
+	return os.WriteFile(fingerprintPath(output), []byte(fingerprint+"\n"), 0644)
+}
@@ -3,11 +3,14 @@ module github.com/Gleipnir-Technology/flogo
 go 1.25.6
 
 require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/andybalholm/brotli v1.2.0
 	github.com/fsnotify/fsnotify v1.9.0
 	github.com/gdamore/tcell/v3 v3.1.2
 	github.com/go-chi/chi/v5 v5.2.5
 	github.com/leaanthony/go-ansi-parser v1.6.1
 	github.com/rs/zerolog v1.34.0
+	golang.org/x/mod v0.40.0
 )
 
 require (
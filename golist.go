@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// goPackage is the subset of the output of 'go list -json' that we use
+type goPackage struct {
+	CFiles     []string
+	CgoFiles   []string
+	CXXFiles   []string
+	Dir        string
+	EmbedFiles []string
+	Error      *goPackageError
+	// The package whose tests this variant of a package is built for, with -test
+	ForTest string
+	GoFiles []string
+	HFiles  []string
+	// Go files in the package directory that build constraints exclude
+	IgnoredGoFiles []string
+	ImportPath     string
+	Imports        []string
+	Module         *goModule
+	Name           string
+	SFiles         []string
+	Standard       bool
+	SysoFiles      []string
+	// Imports of the package's tests
+	TestImports  []string
+	XTestImports []string
+}
+type goPackageError struct {
+	Err string
+}
+type goModule struct {
+	Dir     string
+	GoMod   string
+	Main    bool
+	Path    string
+	Replace *goModule
+	Version string
+}
+
+// SourceFiles gets the absolute paths of every file that goes into building the package
+func (p *goPackage) SourceFiles() []string {
+	result := make([]string, 0)
+	for _, files := range [][]string{p.GoFiles, p.CgoFiles, p.CFiles, p.CXXFiles, p.HFiles, p.SFiles, p.SysoFiles, p.EmbedFiles} {
+		for _, f := range files {
+			result = append(result, filepath.Join(p.Dir, f))
+		}
+	}
+	return result
+}
+
+// IsLocal is true when the package's source can change, rather than being a
+// fixed version of a module in the module cache
+func (p *goPackage) IsLocal() bool {
+	if p.Standard {
+		return false
+	}
+	if p.Module == nil || p.Module.Main {
+		return true
+	}
+	// A replace directive pointing at a directory has no version
+	if p.Module.Replace != nil {
+		return p.Module.Replace.Version == ""
+	}
+	return p.Module.Version == ""
+}
+
+// goList runs 'go list -e -json' in dir with the given flags and patterns
+func goList(dir string, args ...string) ([]goPackage, error) {
+	args = append([]string{"list", "-e", "-json"}, args...)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to run 'go %s' in '%s': %s, %w", strings.Join(args, " "), dir, strings.TrimSpace(stderr.String()), err)
+	}
+	result := make([]goPackage, 0)
+	decoder := json.NewDecoder(bytes.NewReader(output))
+	for {
+		var pkg goPackage
+		err := decoder.Decode(&pkg)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse 'go list' output: %w", err)
+		}
+		result = append(result, pkg)
+	}
+	return result, nil
+}
+
+// findModuleRoot walks up from dir to find the directory containing go.mod
+func findModuleRoot(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get abs path: %w", err)
+	}
+	for d := abs; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, "go.mod")); err == nil {
+			return d, nil
+		}
+		if filepath.Dir(d) == d {
+			return "", fmt.Errorf("no go.mod file found in '%s' or any parent directory, not in a Go module", abs)
+		}
+	}
+}
+
+// findMainPackage determines which main package to build. If pkg is a main
+// package it is used. Otherwise, if there is exactly one main package under
+// pkg that one is used.
+func findMainPackage(target string, pkg string) (*goPackage, error) {
+	if _, err := findModuleRoot(target); err != nil {
+		return nil, err
+	}
+	listed, err := goList(target, pkg)
+	if err != nil {
+		return nil, err
+	}
+	if len(listed) != 1 {
+		return nil, fmt.Errorf("expected '%s' to be a single package, found %d", pkg, len(listed))
+	}
+	p := listed[0]
+	// Without a name there were no Go files, which is fine if there are main packages below
+	if p.Error != nil && p.Name != "" {
+		return nil, fmt.Errorf("'%s' is not buildable: %s", pkg, p.Error.Err)
+	}
+	if p.Name == "main" {
+		return &p, nil
+	}
+
+	below := strings.TrimSuffix(pkg, "/") + "/..."
+	listed, err = goList(target, below)
+	if err != nil {
+		return nil, err
+	}
+	mains := make([]goPackage, 0)
+	for _, l := range listed {
+		if l.Name == "main" && l.Error == nil {
+			mains = append(mains, l)
+		}
+	}
+	switch len(mains) {
+	case 0:
+		if p.Error != nil {
+			return nil, fmt.Errorf("'%s' is not buildable and there are no main packages under it: %s", pkg, p.Error.Err)
+		}
+		return nil, fmt.Errorf("'%s' is package %s, not main, and there are no main packages under it", pkg, p.Name)
+	case 1:
+		return &mains[0], nil
+	}
+	names := make([]string, len(mains))
+	for i, m := range mains {
+		names[i] = relativePackage(target, m.Dir)
+	}
+	return nil, fmt.Errorf("found %d main packages under '%s': %s. Choose one with build.package in %s", len(mains), pkg, strings.Join(names, ", "), configFilename)
+}
+
+// relativePackage gets the package pattern for dir relative to target, like "./cmd/server"
+func relativePackage(target string, dir string) string {
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return dir
+	}
+	rel, err := filepath.Rel(abs, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return dir
+	}
+	if rel == "." {
+		return "."
+	}
+	return "./" + filepath.ToSlash(rel)
+}
+
+var majorVersionSuffix = regexp.MustCompile(`^v[0-9]+$`)
+
+// binaryName determines the name 'go build' gives the binary for a main package
+func binaryName(p *goPackage) string {
+	elems := strings.Split(p.ImportPath, "/")
+	name := elems[len(elems)-1]
+	// "example.com/foo/v2" builds "foo", not "v2"
+	if len(elems) > 1 && majorVersionSuffix.MatchString(name) && p.Module != nil && p.Module.Path == p.ImportPath {
+		name = elems[len(elems)-2]
+	}
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ignoreRule is a single line from a .gitignore file
+type ignoreRule struct {
+	// The directory containing the file the rule came from
+	base string
+	// Where the rule came from, for explaining decisions
+	source string
+	// The pattern, split on "/"
+	segments []string
+	// Whether the pattern contains a "/" and so only matches relative to base
+	anchored bool
+	// Whether the pattern ended in "/" and so only matches directories
+	dirOnly bool
+	// Whether the pattern started with "!" and so un-ignores
+	negate bool
+}
+
+func (r ignoreRule) String() string {
+	return r.source
+}
+
+// match checks the rule against a path, which must be inside the rule's base
+func (r ignoreRule) match(abs string, is_dir bool) bool {
+	if r.dirOnly && !is_dir {
+		return false
+	}
+	rel, err := filepath.Rel(r.base, abs)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if r.anchored {
+		return matchSegments(r.segments, parts)
+	}
+	return matchSegments(r.segments, parts[len(parts)-1:])
+}
+
+// gitignore decides which paths git would ignore, following the .gitignore
+// files in each directory from the top of the repository down
+type gitignore struct {
+	mu sync.Mutex
+	// Whether the target is in a repository. Git doesn't read .gitignore files
+	// outside of one, so neither do we.
+	repo bool
+	// The top of the repository
+	root string
+	// The rules from each directory, by absolute path. Directories that have
+	// been checked but have no rules have an empty slice.
+	rules map[string][]ignoreRule
+}
+
+// newGitignore loads the rules that apply to target from the repository it is in.
+// If target isn't in a git repository no paths are ignored.
+func newGitignore(target string) (*gitignore, error) {
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get abs path: %w", err)
+	}
+	g := &gitignore{
+		root:  abs,
+		rules: make(map[string][]ignoreRule),
+	}
+	for d := abs; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			g.repo = true
+			g.root = d
+			break
+		}
+		if filepath.Dir(d) == d {
+			// Not in a repository, so there is nothing to ignore
+			return g, nil
+		}
+	}
+	exclude, err := parseIgnoreFile(g.root, filepath.Join(g.root, ".git", "info", "exclude"))
+	if err != nil {
+		return nil, err
+	}
+	g.rules[""] = exclude
+	return g, nil
+}
+
+// Match finds the rule that decides whether abs is ignored. The rule is false
+// if no rule applies or the deciding rule is a negation.
+func (g *gitignore) Match(abs string, is_dir bool) (ignoreRule, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var result ignoreRule
+	if !g.repo {
+		return result, false
+	}
+	matched := false
+	for _, rule := range g.rulesFor(filepath.Dir(abs)) {
+		if rule.match(abs, is_dir) {
+			result = rule
+			matched = true
+		}
+	}
+	return result, matched && !result.negate
+}
+
+// rulesFor gets all of the rules that apply inside dir, in the order they apply
+func (g *gitignore) rulesFor(dir string) []ignoreRule {
+	rel, err := filepath.Rel(g.root, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil
+	}
+	result := append([]ignoreRule{}, g.rules[""]...)
+	d := g.root
+	result = append(result, g.loadDir(d)...)
+	if rel == "." {
+		return result
+	}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		d = filepath.Join(d, part)
+		result = append(result, g.loadDir(d)...)
+	}
+	return result
+}
+
+// loadDir gets the rules from the .gitignore in dir, reading it the first time
+func (g *gitignore) loadDir(dir string) []ignoreRule {
+	if rules, ok := g.rules[dir]; ok {
+		return rules
+	}
+	rules, err := parseIgnoreFile(dir, filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		rules = []ignoreRule{}
+	}
+	g.rules[dir] = rules
+	return rules
+}
+
+// Forget drops the cached rules for dir, so that changes to its .gitignore are noticed
+func (g *gitignore) Forget(dir string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.rules, dir)
+}
+
+func parseIgnoreFile(base string, filename string) ([]ignoreRule, error) {
+	result := make([]ignoreRule, 0)
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, fmt.Errorf("Failed to open '%s': %w", filename, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	line_num := 0
+	for scanner.Scan() {
+		line_num++
+		line := strings.TrimRight(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{
+			base:   base,
+			source: fmt.Sprintf("%s:%d %s", filename, line_num, line),
+		}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		// Escaped leading characters are literal
+		line = strings.TrimPrefix(line, `\`)
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.segments = strings.Split(line, "/")
+		result = append(result, rule)
+	}
+	return result, scanner.Err()
+}
+
+// matchSegments matches a path split on "/" against a glob pattern split on
+// "/", where a "**" segment matches any number of path segments
+func matchSegments(pattern []string, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if matchSegments(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	ok, err := path.Match(pattern[0], parts[0])
+	if err != nil || !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], parts[1:])
+}
+
+// matchGlob matches a path relative to the target against a user pattern. Patterns
+// without a "/" match the file name at any depth.
+func matchGlob(pattern string, rel string) bool {
+	parts := strings.Split(rel, "/")
+	if !strings.Contains(pattern, "/") {
+		return matchSegments([]string{pattern}, parts[len(parts)-1:])
+	}
+	return matchSegments(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), parts)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitignoreMatch(t *testing.T) {
+	type check struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}
+	tests := []struct {
+		name string
+		// Files to write, relative to the top of the repository
+		files  map[string]string
+		checks []check
+	}{
+		{
+			name:  "name at any depth",
+			files: map[string]string{".gitignore": "*.log\n"},
+			checks: []check{
+				{"a.log", false, true},
+				{"sub/deep/b.log", false, true},
+				{"a.go", false, false},
+			},
+		},
+		{
+			name:  "leading slash anchors",
+			files: map[string]string{".gitignore": "/build\n"},
+			checks: []check{
+				{"build", true, true},
+				{"sub/build", true, false},
+			},
+		},
+		{
+			name:  "middle slash anchors",
+			files: map[string]string{".gitignore": "docs/gen\n"},
+			checks: []check{
+				{"docs/gen", true, true},
+				{"sub/docs/gen", true, false},
+			},
+		},
+		{
+			name:  "trailing slash only matches directories",
+			files: map[string]string{".gitignore": "tmp/\n"},
+			checks: []check{
+				{"tmp", true, true},
+				{"sub/tmp", true, true},
+				{"tmp", false, false},
+			},
+		},
+		{
+			name:  "negation after the rule",
+			files: map[string]string{".gitignore": "*.log\n!keep.log\n"},
+			checks: []check{
+				{"other.log", false, true},
+				{"keep.log", false, false},
+				{"sub/keep.log", false, false},
+			},
+		},
+		{
+			name:  "negation before the rule",
+			files: map[string]string{".gitignore": "!keep.log\n*.log\n"},
+			checks: []check{
+				{"keep.log", false, true},
+			},
+		},
+		{
+			name: "negation in a nested file",
+			files: map[string]string{
+				".gitignore":     "*.log\n",
+				"sub/.gitignore": "!important.log\n",
+			},
+			checks: []check{
+				{"important.log", false, true},
+				{"sub/important.log", false, false},
+				{"sub/deep/important.log", false, false},
+				{"sub/other.log", false, true},
+			},
+		},
+		{
+			name:  "nested file anchors to its own directory",
+			files: map[string]string{"sub/.gitignore": "/gen\n"},
+			checks: []check{
+				{"sub/gen", true, true},
+				{"sub/x/gen", true, false},
+				{"gen", true, false},
+			},
+		},
+		{
+			name:  "double star",
+			files: map[string]string{".gitignore": "**/cache\na/**/z\n"},
+			checks: []check{
+				{"cache", true, true},
+				{"x/y/cache", true, true},
+				{"a/z", false, true},
+				{"a/b/c/z", false, true},
+				{"b/z", false, false},
+			},
+		},
+		{
+			name:  "comments and escapes",
+			files: map[string]string{".gitignore": "# not.go\n\\#hash\n\\!bang\n"},
+			checks: []check{
+				{"not.go", false, false},
+				{"#hash", false, true},
+				{"!bang", false, true},
+			},
+		},
+		{
+			name:  "info exclude",
+			files: map[string]string{".git/info/exclude": "secret\n"},
+			checks: []check{
+				{"secret", false, true},
+				{"sub/secret", false, true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeFiles(t, root, map[string]string{".git/HEAD": "ref: refs/heads/main\n"})
+			writeFiles(t, root, tt.files)
+			g, err := newGitignore(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range tt.checks {
+				rule, ignored := g.Match(filepath.Join(root, filepath.FromSlash(c.path)), c.isDir)
+				if ignored != c.ignored {
+					t.Errorf("'%s' (dir %t) ignored is %t, want %t (rule '%s')", c.path, c.isDir, ignored, c.ignored, rule)
+				}
+			}
+		})
+	}
+}
+
+func TestGitignoreOutsideRepository(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{".gitignore": "*\n"})
+	g, err := newGitignore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule, ignored := g.Match(filepath.Join(root, "main.go"), false); ignored {
+		t.Errorf("outside a repository main.go is ignored by '%s'", rule)
+	}
+}
+
+func TestGitignoreForget(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{".git/HEAD": "", ".gitignore": "*.log\n"})
+	g, err := newGitignore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(root, "a.log")
+	if _, ignored := g.Match(path, false); !ignored {
+		t.Fatal("a.log should be ignored")
+	}
+	writeFiles(t, root, map[string]string{".gitignore": "*.tmp\n"})
+	if _, ignored := g.Match(path, false); !ignored {
+		t.Error("the rules should be cached until they are forgotten")
+	}
+	g.Forget(root)
+	if rule, ignored := g.Match(path, false); ignored {
+		t.Errorf("a.log is still ignored by '%s' after the change", rule)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		want    bool
+	}{
+		{"*.tmp", "a.tmp", true},
+		{"*.tmp", "sub/a.tmp", true},
+		{"*.tmp", "a.go", false},
+		{"static/*", "static/app.js", true},
+		{"static/*", "sub/static/app.js", false},
+		{"/static/*", "static/app.js", true},
+		{"static/**", "static/js/app.js", true},
+		{"**/*.sql", "db/migrations/1.sql", true},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.rel); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) is %t, want %t", tt.pattern, tt.rel, got, tt.want)
+		}
+	}
+}
+
+// writeFiles writes each of the files under root, making directories as needed
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/rs/zerolog/log"
+)
+
+// Upstream handlers can set this response header to keep flogo from modifying the body
+const headerNoInject = "X-Flogo-No-Inject"
+
+// The markup we add to every proxied HTML page so that it gets the status overlay
+const injectSnippet = `<div id="flogo"></div><script src="/.flogo/injector.js"></script>`
+
+// restrictAcceptEncoding limits the encodings the upstream may use to the ones
+// the client accepts that we can also decode
+func restrictAcceptEncoding(r *http.Request) {
+	header := r.Header.Values("Accept-Encoding")
+	if len(header) == 0 {
+		return
+	}
+	accepted := make([]string, 0)
+	for _, value := range header {
+		for _, part := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			// A quality of 0 means the client doesn't accept it
+			if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+				if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+					continue
+				}
+			}
+			switch coding {
+			case "*":
+				accepted = append(accepted, "gzip", "deflate", "br")
+			case "gzip", "x-gzip", "deflate", "br", "identity":
+				accepted = append(accepted, strings.TrimSpace(part))
+			}
+		}
+	}
+	if len(accepted) == 0 {
+		// Nothing we can decode, like only "zstd". The client may have refused
+		// the body as it is, so leave the header alone and the page without
+		// the overlay.
+		return
+	}
+	r.Header.Set("Accept-Encoding", strings.Join(accepted, ", "))
+}
+
+// injectResponse is used as the ModifyResponse hook on the reverse proxy. It adds
+// the flogo container and script to HTML responses, decoding the body if necessary.
+func injectResponse(resp *http.Response) error {
+	if resp.Header.Get(headerNoInject) != "" {
+		resp.Header.Del(headerNoInject)
+		return nil
+	}
+	if !shouldInject(resp) {
+		return nil
+	}
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if !canDecode(encoding) {
+		// We don't know how to decode it, so leave it alone
+		log.Debug().Str("encoding", encoding).Msg("not injecting into response")
+		return nil
+	}
+	raw, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("reading upstream body: %w", err)
+	}
+	body, err := decodeBody(raw, encoding)
+	if err != nil {
+		// Better to show the page without the overlay than not at all
+		log.Warn().Err(err).Str("encoding", encoding).Msg("not injecting into response we couldn't decode")
+		resp.Body = io.NopCloser(bytes.NewReader(raw))
+		return nil
+	}
+
+	modified := injectHTML(body)
+	resp.Body = io.NopCloser(bytes.NewReader(modified))
+	resp.ContentLength = int64(len(modified))
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(modified)))
+	// The body no longer matches what the upstream hashed
+	resp.Header.Del("ETag")
+	return nil
+}
+
+func shouldInject(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	media_type, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return media_type == "text/html"
+}
+
+func canDecode(encoding string) bool {
+	switch encoding {
+	case "", "identity", "gzip", "x-gzip", "deflate", "br":
+		return true
+	}
+	return false
+}
+
+func decodeBody(body []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("gzip reader: %w", err)
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case "deflate":
+		// "deflate" is supposed to be zlib, but some servers send raw deflate
+		r, err := zlib.NewReader(bytes.NewReader(body))
+		if err == nil {
+			defer r.Close()
+			result, err := io.ReadAll(r)
+			if err == nil {
+				return result, nil
+			}
+		}
+		fr := flate.NewReader(bytes.NewReader(body))
+		defer fr.Close()
+		result, err := io.ReadAll(fr)
+		if err != nil {
+			return nil, fmt.Errorf("deflate reader: %w", err)
+		}
+		return result, nil
+	case "br":
+		result, err := io.ReadAll(brotli.NewReader(bytes.NewReader(body)))
+		if err != nil {
+			return nil, fmt.Errorf("brotli reader: %w", err)
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("unsupported content-encoding '%s'", encoding)
+}
+
+// injectHTML adds the snippet right before the closing body tag, or at the end of
+// the document if there isn't one. Pages that already include the container are
+// left alone.
+func injectHTML(body []byte) []byte {
+	lower := bytes.ToLower(body)
+	if bytes.Contains(lower, []byte(`id="flogo"`)) {
+		return body
+	}
+	idx := bytes.LastIndex(lower, []byte("</body>"))
+	if idx < 0 {
+		return append(body, []byte(injectSnippet)...)
+	}
+	result := make([]byte, 0, len(body)+len(injectSnippet))
+	result = append(result, body[:idx]...)
+	result = append(result, []byte(injectSnippet)...)
+	result = append(result, body[idx:]...)
+	return result
+}
@@ -11,6 +11,7 @@ class StatusDisplay {
 			CONNECTING: "connecting",
 			ERROR: "error",
 			FINE: "fine",
+			WARNING: "warning",
 		};
 
 		this.COLORS = {
@@ -19,6 +20,8 @@ class StatusDisplay {
 			CONNECTING: "#fff9c4",
 			ERROR: "#ffebee",
 			ERROR_TEXT: "#c62828",
+			WARNING: "#fff3e0",
+			WARNING_TEXT: "#e65100",
 		};
 
 		this.init();
@@ -110,6 +113,18 @@ class StatusDisplay {
 			this.statusBar.style.color = this.COLORS.ERROR_TEXT;
 			this.statusMessage.textContent = message || "❌ Error occurred";
 
+			if (stackTrace) {
+				this.errorDetail.style.display = "block";
+				this.errorStack.textContent = stackTrace;
+			} else {
+				this.errorDetail.style.display = "none";
+			}
+		} else if (status === this.STATUS.WARNING) {
+			this.statusBar.style.display = "block";
+			this.statusBar.style.background = this.COLORS.WARNING;
+			this.statusBar.style.color = this.COLORS.WARNING_TEXT;
+			this.statusMessage.textContent = message || "⚠️ Warning";
+
 			if (stackTrace) {
 				this.errorDetail.style.display = "block";
 				this.errorStack.textContent = stackTrace;
@@ -132,6 +147,31 @@ class StatusDisplay {
 		this.setStatus(this.STATUS.ERROR, message, stackTrace);
 	}
 
+	showTestFailures(tester) {
+		const details = tester.failures
+			.map((f) => `--- ${f.package} ${f.test}\n${f.output}`)
+			.join("\n");
+		this.setStatus(
+			this.STATUS.ERROR,
+			`❌ tests failed: ${tester.passed} passed, ${tester.failed} failed`,
+			details,
+		);
+	}
+
+	showDiagnostics(analyzer) {
+		const details = analyzer.diagnostics
+			.map(
+				(d) =>
+					`${d.file}:${d.line}:${d.column}: ${d.message} (${d.source})`,
+			)
+			.join("\n");
+		this.setStatus(
+			this.STATUS.WARNING,
+			`⚠️ ${analyzer.diagnostics.length} warnings`,
+			details,
+		);
+	}
+
 	hide() {
 		this.setStatus(this.STATUS.FINE);
 	}
@@ -143,18 +183,119 @@ class StatusDisplay {
 	}
 }
 
+// The output of each process, built up from the lines the server sends as they arrive
+const outputs = new Map();
+
+// Add the lines in a process message to the ones we have for its slot, and put
+// all of them back in the message
+function mergeOutput(slot, process) {
+	if (!process) {
+		outputs.delete(slot);
+		return;
+	}
+	let lines = process.reset ? [] : outputs.get(slot) || [];
+	// Partial lines are sent again each time until the rest arrives
+	lines = lines.filter((l) => !l.partial && l.seq >= process.start);
+	lines.push(...process.lines);
+	outputs.set(slot, lines);
+	process.lines = lines;
+}
+
+function mergeOutputs(content) {
+	mergeOutput("builder.current", content.builder.current);
+	mergeOutput("builder.previous", content.builder.previous);
+	mergeOutput("runner.current", content.runner.current);
+	mergeOutput("runner.previous", content.runner.previous);
+}
+
 function updateState(statusDisplay, content) {
 	if (content.builder.status == "failed") {
+		const build = content.builder.current || content.builder.previous;
 		statusDisplay.showError(
 			"build failed",
-			content.builder.stderr + content.builder.stdout,
+			build ? build.lines.map((l) => l.text).join("\n") : null,
 		);
-	} else if (content.builder.status == "compiling") {
+	} else if (
+		content.builder.status == "compiling" ||
+		content.builder.status == "cancelled"
+	) {
 		statusDisplay.showBuilding("compiling...");
+	} else if (content.tester && content.tester.status == "failed") {
+		statusDisplay.showTestFailures(content.tester);
+	} else if (content.analyzer && content.analyzer.status == "warnings") {
+		statusDisplay.showDiagnostics(content.analyzer);
 	} else {
 		statusDisplay.hide();
 	}
 }
+const SCROLL_KEY = "flogo-scroll";
+
+// Remember where we were on the page so we can come back to it after the reload
+function reloadPage() {
+	sessionStorage.setItem(
+		SCROLL_KEY,
+		JSON.stringify({
+			path: window.location.pathname,
+			x: window.scrollX,
+			y: window.scrollY,
+		}),
+	);
+	window.location.reload();
+}
+
+function restoreScroll() {
+	const saved = sessionStorage.getItem(SCROLL_KEY);
+	if (!saved) {
+		return;
+	}
+	sessionStorage.removeItem(SCROLL_KEY);
+	const position = JSON.parse(saved);
+	if (position.path !== window.location.pathname) {
+		return;
+	}
+	window.scrollTo(position.x, position.y);
+}
+
+window.addEventListener("load", restoreScroll);
+
+// Decide if the URL in an element refers to the file that changed. The server
+// may mount static files under a different prefix than the directory they live
+// in, so fall back to comparing file names.
+function isChangedAsset(url, path) {
+	const pathname = new URL(url, window.location.href).pathname;
+	if (pathname.endsWith(path) || path.endsWith(pathname)) {
+		return true;
+	}
+	const filename = path.substring(path.lastIndexOf("/") + 1);
+	return pathname.substring(pathname.lastIndexOf("/") + 1) === filename;
+}
+
+function cacheBust(url) {
+	const busted = new URL(url, window.location.href);
+	busted.searchParams.set("flogo", Date.now().toString());
+	return busted.toString();
+}
+
+// Re-fetch stylesheets and images that match the changed file without reloading the page
+function swapAsset(path) {
+	document.querySelectorAll('link[rel="stylesheet"]').forEach((link) => {
+		if (!isChangedAsset(link.href, path)) {
+			return;
+		}
+		// Load the new sheet next to the old one so the page never renders unstyled
+		const replacement = link.cloneNode();
+		replacement.href = cacheBust(link.href);
+		replacement.addEventListener("load", () => link.remove());
+		replacement.addEventListener("error", () => replacement.remove());
+		link.after(replacement);
+	});
+	document.querySelectorAll("img").forEach((img) => {
+		if (img.src && isChangedAsset(img.src, path)) {
+			img.src = cacheBust(img.src);
+		}
+	});
+}
+
 document.addEventListener("DOMContentLoaded", function () {
 	const flogoElement = document.getElementById("flogo");
 	const statusDisplay = new StatusDisplay(flogoElement);
@@ -172,6 +313,8 @@ document.addEventListener("DOMContentLoaded", function () {
 		}
 
 		statusDisplay.showConnecting();
+		// A new connection starts each process's output over
+		outputs.clear();
 		eventSource = new EventSource("/.flogo/events");
 
 		eventSource.onopen = function () {
@@ -183,7 +326,14 @@ document.addEventListener("DOMContentLoaded", function () {
 			const msg = JSON.parse(event.data);
 			if (msg.type === "heartbeat") {
 				return;
+			} else if (msg.type === "asset-changed") {
+				console.log("flogo: asset changed", msg.content.path);
+				swapAsset(msg.content.path);
+			} else if (msg.type === "reload") {
+				console.log("flogo: reloading");
+				reloadPage();
 			} else if (msg.type === "state") {
+				mergeOutputs(msg.content);
 				updateState(statusDisplay, msg.content);
 			} else {
 				console.warn("Need to handle flogo message", msg.type, msg);
@@ -25,8 +25,8 @@ const (
 	unknownLevel = "???"
 )
 
-func setupLogging(file *os.File) zerolog.Logger {
-	if os.Getenv("FLOGO_VERBOSE") != "" {
+func setupLogging(file *os.File, verbose bool) zerolog.Logger {
+	if verbose {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	} else {
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
@@ -56,7 +56,7 @@ func setupLogging(file *os.File) zerolog.Logger {
 	// Create logger with timestamp
 	log.Logger = zerolog.New(writer).With().Timestamp().Caller().Logger()
 
-	log.Debug().Msg("Running in verbose mode due to FLOGO_VERBOSE")
+	log.Debug().Msg("Running in verbose mode")
 	return log.Logger
 }
 
@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"net/url"
 	"os"
 	"runtime/debug"
 
@@ -13,11 +12,27 @@ import (
 
 func main() {
 	var err error
-	ui_type := os.Getenv("FLOGO_UI")
-
-	var target = flag.String("target", ".", "The directory containing the go project to build")
+	flags := newConfigFlags(flag.CommandLine)
+	var watched = flag.Bool("watched", false, "Print what happens when each file in the target changes, and why, then exit")
 	flag.Parse()
 
+	cfg, err := loadConfig(flag.CommandLine, flags)
+	if err != nil {
+		fmt.Printf("Invalid configuration: %v\n", err)
+		os.Exit(2)
+	}
+	if *watched {
+		w, err := cfg.NewWatcher(nil)
+		if err == nil {
+			err = w.Explain(os.Stdout)
+		}
+		if err != nil {
+			fmt.Printf("Failed to explain watched files: %v\n", err)
+			os.Exit(5)
+		}
+		return
+	}
+
 	file, err := os.OpenFile(
 		"flogo.log",
 		os.O_APPEND|os.O_CREATE|os.O_WRONLY,
@@ -28,31 +43,17 @@ func main() {
 		os.Exit(1)
 	}
 	defer file.Close()
-	logger := setupLogging(file)
-
-	bind := os.Getenv("FLOGO_BIND")
-	if bind == "" {
-		bind = ":10000" // Default if not specified
-	}
-	// Get the upstream URL from environment variable
-	upstream := os.Getenv("FLOGO_UPSTREAM")
-	if upstream == "" {
-		upstream = "http://localhost:9001" // Default if not specified
-	}
+	logger := setupLogging(file, cfg.Verbose)
 
-	upstreamURL, err = url.Parse(upstream)
-	if err != nil {
-		fmt.Printf("Failed to parse '%s' as a URL: %v\n", upstream, err)
-		os.Exit(2)
-	}
+	upstreamURL = cfg.UpstreamURL
 	var u ui.UI
-	switch ui_type {
-	case "", "tcell":
-		u, err = ui.NewTUI(*target, *upstreamURL)
+	switch cfg.UI {
+	case "tcell":
+		u, err = ui.NewTUI(cfg.Target, *upstreamURL)
 	case "flat":
-		u, err = ui.NewFlat(*target, *upstreamURL)
+		u, err = ui.NewFlat(cfg.Target, *upstreamURL)
 	default:
-		fmt.Printf("Unrecognized FLOGO_UI '%s'\n", ui_type)
+		fmt.Printf("Unrecognized UI '%s'\n", cfg.UI)
 		os.Exit(3)
 	}
 	if err != nil {
@@ -76,7 +77,7 @@ func main() {
 			fmt.Fprintf(os.Stderr, "PANIC: %v\n%s\n", r, debug.Stack())
 		}
 	}()
-	err = mgr.Run(logger, u, bind, *target)
+	err = mgr.Run(logger, u, cfg)
 	if err != nil {
 		fmt.Printf("%+v", err)
 		os.Exit(1)
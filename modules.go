@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// localDependencies finds the directories of the modules the build in target
+// uses from local source outside of target: go.mod replace directives that
+// point at directories, and go.work members.
+func localDependencies(target string) ([]string, error) {
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get abs path: %w", err)
+	}
+	root, err := findModuleRoot(abs)
+	if err != nil {
+		return nil, err
+	}
+	gowork, err := goWorkFile(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make(map[string]bool)
+	// The main modules are the go.work members, or just our module
+	mains := []string{root}
+	if gowork != "" {
+		members, replaced, err := parseGoWork(gowork)
+		if err != nil {
+			return nil, err
+		}
+		mains = members
+		for _, d := range replaced {
+			dirs[d] = true
+		}
+	}
+	// Only the main modules' replace directives apply to the build
+	for _, m := range mains {
+		dirs[m] = true
+		replaced, err := parseGoModReplaces(filepath.Join(m, "go.mod"))
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range replaced {
+			dirs[d] = true
+		}
+	}
+
+	result := make([]string, 0, len(dirs))
+	for d := range dirs {
+		// Already watched with the target
+		if isWithin(abs, d) {
+			continue
+		}
+		result = append(result, d)
+	}
+	sort.Strings(result)
+	// A directory inside another one is watched along with it
+	deduped := make([]string, 0, len(result))
+	for _, d := range result {
+		inside := false
+		for _, o := range deduped {
+			inside = inside || isWithin(o, d)
+		}
+		if !inside {
+			deduped = append(deduped, d)
+		}
+	}
+	return deduped, nil
+}
+
+// goWorkFile gets the go.work file that applies in dir, or "" when there is none
+func goWorkFile(dir string) (string, error) {
+	cmd := exec.Command("go", "env", "GOWORK")
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to run 'go env GOWORK': %w", err)
+	}
+	result := strings.TrimSpace(string(output))
+	if result == "off" {
+		return "", nil
+	}
+	return result, nil
+}
+
+// parseGoWork gets the directories of the modules a go.work file uses, and
+// the directories its replace directives point at
+func parseGoWork(path string) ([]string, []string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read '%s': %w", path, err)
+	}
+	work, err := modfile.ParseWork(path, content, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse '%s': %w", path, err)
+	}
+	base := filepath.Dir(path)
+	members := make([]string, 0, len(work.Use))
+	for _, u := range work.Use {
+		members = append(members, resolveModuleDir(base, u.Path))
+	}
+	return members, localReplaces(base, work.Replace), nil
+}
+
+// parseGoModReplaces gets the directories the replace directives in a go.mod file point at
+func parseGoModReplaces(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read '%s': %w", path, err)
+	}
+	mod, err := modfile.Parse(path, content, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse '%s': %w", path, err)
+	}
+	return localReplaces(filepath.Dir(path), mod.Replace), nil
+}
+
+func localReplaces(base string, replaces []*modfile.Replace) []string {
+	result := make([]string, 0)
+	for _, r := range replaces {
+		// Replacements with a version are modules, not directories
+		if r.New.Version != "" {
+			continue
+		}
+		result = append(result, resolveModuleDir(base, r.New.Path))
+	}
+	return result
+}
+
+func resolveModuleDir(base string, path string) string {
+	path = filepath.FromSlash(path)
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(base, path)
+}
+
+// isWithin is true when path is dir or is inside it
+func isWithin(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// How the watcher finds out about changes
+type WatchMode int
+
+const (
+	// Use the operating system's notifications, falling back to polling when they run out
+	WatchModeAuto WatchMode = iota
+	// Only use the operating system's notifications
+	WatchModeNotify
+	// Check the files on an interval
+	WatchModePoll
+)
+
+// ParseWatchMode converts the name of a mode from the configuration
+func ParseWatchMode(s string) (WatchMode, error) {
+	switch s {
+	case "auto":
+		return WatchModeAuto, nil
+	case "notify":
+		return WatchModeNotify, nil
+	case "poll":
+		return WatchModePoll, nil
+	}
+	return WatchModeAuto, fmt.Errorf("'%s' is not one of 'auto', 'notify' or 'poll'", s)
+}
+
+// notifier reports changes to the files in the directories it watches. Like
+// fsnotify, watching a directory doesn't watch the directories inside it.
+type notifier interface {
+	Add(path string) error
+	Close() error
+	Errors() <-chan error
+	Events() <-chan fsnotify.Event
+	Remove(path string) error
+}
+
+// fsNotifier uses the operating system's notifications
+type fsNotifier struct {
+	watcher *fsnotify.Watcher
+}
+
+func newFSNotifier() (*fsNotifier, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &fsNotifier{watcher: watcher}, nil
+}
+func (n *fsNotifier) Add(path string) error         { return n.watcher.Add(path) }
+func (n *fsNotifier) Close() error                  { return n.watcher.Close() }
+func (n *fsNotifier) Errors() <-chan error          { return n.watcher.Errors }
+func (n *fsNotifier) Events() <-chan fsnotify.Event { return n.watcher.Events }
+func (n *fsNotifier) Remove(path string) error      { return n.watcher.Remove(path) }
+
+// isNotifyLimit is true when the error means the operating system won't give us
+// any more notifications, like when we hit fs.inotify.max_user_watches
+func isNotifyLimit(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE)
+}
+
+// pollStat is what we know about a file the last time we looked
+type pollStat struct {
+	hash    [sha256.Size]byte
+	isDir   bool
+	modTime time.Time
+	size    int64
+}
+
+// pollNotifier checks the files in each directory on an interval. It works
+// where notifications don't, like NFS, SSHFS and some container bind mounts.
+type pollNotifier struct {
+	cancel   context.CancelFunc
+	errors   chan error
+	events   chan fsnotify.Event
+	interval time.Duration
+	mu       sync.Mutex
+	// What was in each watched directory the last time we looked, by absolute path
+	dirs map[string]map[string]pollStat
+}
+
+func newPollNotifier(interval time.Duration) *pollNotifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &pollNotifier{
+		cancel:   cancel,
+		dirs:     make(map[string]map[string]pollStat),
+		errors:   make(chan error),
+		events:   make(chan fsnotify.Event),
+		interval: interval,
+	}
+	go n.run(ctx)
+	return n
+}
+func (n *pollNotifier) Add(path string) error {
+	entries, err := statDir(path, nil)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dirs[path] = entries
+	return nil
+}
+func (n *pollNotifier) Close() error {
+	n.cancel()
+	return nil
+}
+func (n *pollNotifier) Errors() <-chan error          { return n.errors }
+func (n *pollNotifier) Events() <-chan fsnotify.Event { return n.events }
+func (n *pollNotifier) Remove(path string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.dirs[path]; !ok {
+		return fmt.Errorf("'%s' is not watched", path)
+	}
+	delete(n.dirs, path)
+	return nil
+}
+
+func (n *pollNotifier) run(ctx context.Context) {
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Don't hold the lock while sending, the reader may be adding a directory
+		for _, event := range n.poll() {
+			select {
+			case <-ctx.Done():
+				return
+			case n.events <- event:
+			}
+		}
+	}
+}
+
+// poll looks at every watched directory and gets the changes since last time
+func (n *pollNotifier) poll() []fsnotify.Event {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	result := make([]fsnotify.Event, 0)
+	for dir, before := range n.dirs {
+		after, err := statDir(dir, before)
+		if err != nil {
+			// The directory is gone, so is everything in it
+			delete(n.dirs, dir)
+			result = append(result, fsnotify.Event{Name: dir, Op: fsnotify.Remove})
+			continue
+		}
+		for name, a := range after {
+			b, ok := before[name]
+			switch {
+			case !ok:
+				result = append(result, fsnotify.Event{Name: name, Op: fsnotify.Create})
+			case a.isDir != b.isDir:
+				result = append(result, fsnotify.Event{Name: name, Op: fsnotify.Remove})
+				result = append(result, fsnotify.Event{Name: name, Op: fsnotify.Create})
+			case !a.isDir && (a.size != b.size || a.hash != b.hash):
+				result = append(result, fsnotify.Event{Name: name, Op: fsnotify.Write})
+			}
+		}
+		for name := range before {
+			if _, ok := after[name]; !ok {
+				result = append(result, fsnotify.Event{Name: name, Op: fsnotify.Remove})
+			}
+		}
+		n.dirs[dir] = after
+	}
+	return result
+}
+
+// statDir gets what is in dir. Files are only hashed when their size or
+// modification time differs from before, so touching a file isn't a change.
+func statDir(dir string, before map[string]pollStat) (map[string]pollStat, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]pollStat, len(entries))
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			// Removed since we read the directory
+			continue
+		}
+		s := pollStat{
+			isDir:   info.IsDir(),
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		}
+		if s.isDir {
+			result[name] = s
+			continue
+		}
+		b, ok := before[name]
+		if ok && !b.isDir && b.size == s.size && b.modTime.Equal(s.modTime) {
+			s.hash = b.hash
+		} else {
+			h := sha256.New()
+			if hashFile(h, name) == nil {
+				copy(s.hash[:], h.Sum(nil))
+			}
+		}
+		result[name] = s
+	}
+	return result, nil
+}
@@ -0,0 +1,19 @@
+//go:build unix && !linux
+
+package process
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Only Linux can kill the process when flogo dies
+func setDeathSignal(attr *syscall.SysProcAttr) {}
+
+// groupMembers can't list the processes without /proc, only say that there are some
+func groupMembers(pgid int) []string {
+	if syscall.Kill(-pgid, 0) != nil {
+		return nil
+	}
+	return []string{fmt.Sprintf("processes in group %d", pgid)}
+}
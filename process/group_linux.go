@@ -0,0 +1,50 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// setDeathSignal kills the process if flogo dies without stopping it, so it
+// doesn't hold on to its port
+func setDeathSignal(attr *syscall.SysProcAttr) {
+	attr.Pdeathsig = syscall.SIGKILL
+}
+
+// groupMembers describes the processes still in the group, like "1234 (node)".
+// Zombies are left out, they are gone as far as anyone else can tell.
+func groupMembers(pgid int) []string {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return nil
+	}
+	result := make([]string, 0)
+	for _, path := range stats {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			// Exited since we listed them
+			continue
+		}
+		// The format is "pid (comm) state ppid pgrp ...", and comm can contain anything
+		end := bytes.LastIndexByte(content, ')')
+		start := bytes.IndexByte(content, '(')
+		if start < 0 || end < start {
+			continue
+		}
+		fields := bytes.Fields(content[end+1:])
+		if len(fields) < 3 || string(fields[0]) == "Z" {
+			continue
+		}
+		pgrp, err := strconv.Atoi(string(fields[2]))
+		if err != nil || pgrp != pgid {
+			continue
+		}
+		pid := bytes.TrimSpace(content[:start])
+		result = append(result, fmt.Sprintf("%s (%s)", pid, content[start+1:end]))
+	}
+	return result
+}
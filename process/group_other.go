@@ -0,0 +1,24 @@
+//go:build !unix
+
+package process
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Process groups are a unix thing, elsewhere only the process itself is signalled
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func signalGroup(pgid int, s syscall.Signal) error {
+	p, err := os.FindProcess(pgid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(s)
+}
+
+func groupMembers(pgid int) []string {
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package process
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes the command the leader of a new process group
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	setDeathSignal(cmd.SysProcAttr)
+}
+
+// signalGroup signals every process in the group
+func signalGroup(pgid int, s syscall.Signal) error {
+	return syscall.Kill(-pgid, s)
+}
@@ -0,0 +1,283 @@
+package process
+
+import (
+	"bytes"
+	"iter"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leaanthony/go-ansi-parser"
+)
+
+// How many lines of output are kept for a process when nothing else is set
+const DefaultCapacity = 10000
+
+// Which stream a line of output came from
+type Stream int
+
+const (
+	StreamStdout Stream = iota
+	StreamStderr
+)
+
+func (s Stream) String() string {
+	switch s {
+	case StreamStdout:
+		return "stdout"
+	case StreamStderr:
+		return "stderr"
+	}
+	return "unknown"
+}
+
+// Line is a line of output and what we know about it
+type Line struct {
+	// The line as it was written, without the newline
+	Data []byte
+	// Whether the rest of the line hasn't arrived yet, like a prompt or a
+	// progress bar. It changes as more arrives.
+	Partial bool
+	// Numbers the lines of a process in the order they arrived, starting at 0.
+	// Partial lines have the number the next line will get.
+	Seq    int
+	Stream Stream
+	// The line split up by its ANSI styling
+	Styled []*ansi.StyledText
+	// When the line arrived. It has a monotonic reading, so subtracting
+	// another time from the same run is safe from clock changes.
+	Time time.Time
+}
+
+// Text gets the line without ANSI codes
+func (l Line) Text() string {
+	var b strings.Builder
+	for _, s := range l.Styled {
+		b.WriteString(s.Label)
+	}
+	return b.String()
+}
+
+// Lines is the output of a process, one line at a time. Once it holds its
+// capacity the oldest lines are dropped, so a chatty program can run for days.
+// Readers can ask for only the lines that were added since they last looked.
+type Lines struct {
+	mu       sync.RWMutex
+	capacity int
+	// The lines, as a ring that starts at start once it is full
+	lines []Line
+	// The sequence number of the next line
+	next int
+	// The line being written on each stream, until the rest of it arrives
+	partial map[Stream]Line
+	start   int
+	started time.Time
+}
+
+func NewLines(capacity int) *Lines {
+	if capacity < 1 {
+		capacity = DefaultCapacity
+	}
+	return &Lines{
+		capacity: capacity,
+		lines:    make([]Line, 0),
+		partial:  make(map[Stream]Line),
+		started:  time.Now(),
+	}
+}
+
+// Append adds a copy of a line that just arrived
+func (l *Lines) Append(stream Stream, data []byte) {
+	c := bytes.Clone(data)
+	if c == nil {
+		c = []byte{}
+	}
+	l.AppendLine(Line{
+		Data:   c,
+		Stream: stream,
+		Styled: parseStyled(c),
+		Time:   time.Now(),
+	})
+}
+
+// SetPartial sets what has arrived of the line being written on the stream,
+// which is replaced when more arrives
+func (l *Lines) SetPartial(stream Stream, data []byte) {
+	c := bytes.Clone(data)
+	if c == nil {
+		c = []byte{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.partial[stream] = Line{
+		Data:    c,
+		Partial: true,
+		Stream:  stream,
+		Styled:  parseStyled(c),
+		Time:    time.Now(),
+	}
+}
+
+// AppendLine adds a line from somewhere else, like another process, keeping
+// its stream and time but giving it the next sequence number. It replaces the
+// partial line on its stream.
+func (l *Lines) AppendLine(line Line) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.partial, line.Stream)
+	line.Partial = false
+	line.Seq = l.next
+	if len(l.lines) < l.capacity {
+		l.lines = append(l.lines, line)
+	} else {
+		l.lines[l.start] = line
+		l.start = (l.start + 1) % l.capacity
+	}
+	l.next++
+}
+
+// All iterates over the lines that are kept, and the partial lines after them,
+// as they were when it started
+func (l *Lines) All() iter.Seq[Line] {
+	var lines []Line
+	if l != nil {
+		l.mu.RLock()
+		lines = l.withPartial(l.between(l.next-len(l.lines), l.next))
+		l.mu.RUnlock()
+	}
+	return func(yield func(Line) bool) {
+		for _, line := range lines {
+			if !yield(line) {
+				return
+			}
+		}
+	}
+}
+
+// Bytes gets the lines that are kept, each ending in a newline
+func (l *Lines) Bytes() []byte {
+	var b bytes.Buffer
+	for line := range l.All() {
+		b.Write(line.Data)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// StreamBytes gets the lines from one stream that are kept, each ending in a newline
+func (l *Lines) StreamBytes(stream Stream) []byte {
+	var b bytes.Buffer
+	for line := range l.All() {
+		if line.Stream != stream {
+			continue
+		}
+		b.Write(line.Data)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// Len gets how many lines are kept
+func (l *Lines) Len() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.lines)
+}
+
+// Next gets the sequence number the next line will have, which is also how
+// many lines there have been
+func (l *Lines) Next() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.next
+}
+
+// Range gets the lines with sequence numbers from 'from' up to but not
+// including 'to'. Lines that were already dropped are skipped.
+func (l *Lines) Range(from int, to int) []Line {
+	if l == nil {
+		return []Line{}
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.between(from, to)
+}
+
+// Since gets the lines from sequence number seq on, and the sequence number to
+// ask for next time. Lines that were already dropped are skipped.
+func (l *Lines) Since(seq int) ([]Line, int) {
+	if l == nil {
+		return []Line{}, seq
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.between(seq, l.next), l.next
+}
+
+// Partial gets the lines still being written, which Since and Range leave out
+func (l *Lines) Partial() []Line {
+	if l == nil {
+		return []Line{}
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.withPartial([]Line{})
+}
+
+// Started gets when the lines started, for showing how far into a run each arrived
+func (l *Lines) Started() time.Time {
+	if l == nil {
+		return time.Time{}
+	}
+	return l.started
+}
+
+// Tail gets the last n lines, including partial lines
+func (l *Lines) Tail(n int) []Line {
+	if l == nil {
+		return []Line{}
+	}
+	n = max(n, 0)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	lines := l.withPartial(l.between(l.next-n, l.next))
+	return lines[max(len(lines)-n, 0):]
+}
+
+// withPartial adds the partial lines after the complete ones
+func (l *Lines) withPartial(lines []Line) []Line {
+	for _, stream := range []Stream{StreamStdout, StreamStderr} {
+		if p, ok := l.partial[stream]; ok {
+			p.Seq = l.next
+			lines = append(lines, p)
+		}
+	}
+	return lines
+}
+
+func (l *Lines) between(from int, to int) []Line {
+	first := l.next - len(l.lines)
+	from = max(from, first)
+	to = min(to, l.next)
+	result := make([]Line, 0, max(to-from, 0))
+	for i := from; i < to; i++ {
+		result = append(result, l.lines[(l.start+i-first)%len(l.lines)])
+	}
+	return result
+}
+
+// parseStyled splits a line up by its ANSI styling. A line with codes we don't
+// understand is kept as it is.
+func parseStyled(data []byte) []*ansi.StyledText {
+	styled, err := ansi.Parse(string(data), ansi.WithIgnoreInvalidCodes())
+	if err != nil {
+		return []*ansi.StyledText{{Label: string(data)}}
+	}
+	return styled
+}
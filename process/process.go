@@ -1,13 +1,13 @@
 package process
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"sync"
 	"syscall"
 	"time"
 
@@ -25,181 +25,550 @@ const (
 type EventProcess struct {
 	Data         []byte
 	ProcessState *os.ProcessState
-	Type         EventProcessType
+	// The signal that ended the process, for EventProcessStop. See StopSignal.
+	StopSignal syscall.Signal
+	Type       EventProcessType
 }
+
+// State is where a process is in its life
+type State int
+
+const (
+	// Never started, or failed to start
+	StateIdle State = iota
+	StateStarting
+	StateRunning
+	// Signalled to stop, but hasn't exited yet
+	StateStopping
+	StateExited
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateStarting:
+		return "starting"
+	case StateRunning:
+		return "running"
+	case StateStopping:
+		return "stopping"
+	case StateExited:
+		return "exited"
+	}
+	return "unknown"
+}
+
+// ErrNotStarted is returned by Wait when there is no run to wait for
+var ErrNotStarted = errors.New("process has not started")
+
+// Process runs a program, and runs it again when asked. It is safe to use from
+// several goroutines at once.
 type Process struct {
-	// Contains the exit code after the program exits
-	ExitCode *int
-	OnEvent  *SubscriptionManager[EventProcess]
-	// Contains the interleaved total output emitted by this process
-	Output bytes.Buffer
-	// Contains all of stdeer that has been emitted by this process
-	Stderr bytes.Buffer
-	// Contains all of stdout that has been emitted by this process
-	Stdout bytes.Buffer
-
-	args       []string
+	OnEvent *SubscriptionManager[EventProcess]
+
 	chanStderr chan []byte
 	chanStdout chan []byte
-	cmd        *exec.Cmd
-	dir        string
-	isRunning  bool
 	target     string
+
+	mu   sync.Mutex
+	args []string
+	// How many lines of output to keep
+	capacity int
+	cmd      *exec.Cmd
+	dir      string
+	// Closed when the latest run exits
+	done chan struct{}
+	env  []string
+	// How the latest run exited, nil until it does
+	exited *os.ProcessState
+	// Whether the process gets its own process group
+	group bool
+	// The latest lines of stdout and stderr, in the order they arrived. Each
+	// start gets a new buffer, so the output of a run can still be read after
+	// the next one starts.
+	output *Lines
+	// The process group to clean up after the process, 0 if it doesn't have one
+	pgid int
+	// Closed when the process is done starting, whether or not it worked
+	started chan struct{}
+	state   State
+	// The last signal sent to stop the latest run, 0 if there wasn't one
+	stopSignal syscall.Signal
+	// The signals Stop sends, in order, and how long it waits after each
+	stopSignals []syscall.Signal
+	stopTimeout time.Duration
 }
 
 func New(target string, args ...string) *Process {
+	done := make(chan struct{})
+	close(done)
 	return &Process{
-		ExitCode:   nil,
-		OnEvent:    NewSubscriptionManager[EventProcess](),
-		Stdout:     bytes.Buffer{},
-		Stderr:     bytes.Buffer{},
-		args:       args,
-		chanStderr: make(chan []byte),
-		chanStdout: make(chan []byte),
-		cmd:        nil,
-		isRunning:  false,
-		target:     target,
-	}
-}
-
-// Restart the process.
-// If the process is running, signals the process to exit, waits for exit,
-// then calls "Start"
-// Provides an error if the process is already running
+		OnEvent:     NewSubscriptionManager[EventProcess](),
+		args:        args,
+		capacity:    DefaultCapacity,
+		chanStderr:  make(chan []byte),
+		chanStdout:  make(chan []byte),
+		cmd:         nil,
+		done:        done,
+		output:      NewLines(DefaultCapacity),
+		state:       StateIdle,
+		stopSignals: DefaultStopSignals,
+		stopTimeout: DefaultStopTimeout,
+		target:      target,
+	}
+}
+
+// Args gets the arguments the process is started with
+func (p *Process) Args() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.args
+}
+
+// Done gets a channel that is closed when the latest run exits. It is already
+// closed if the process isn't running.
+func (p *Process) Done() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done
+}
+
+// Env gets the extra environment variables the process is started with
+func (p *Process) Env() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.env
+}
+
+// Output gets the output of the latest run
+func (p *Process) Output() *Lines {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.output
+}
+
+// Path gets the program the process runs
+func (p *Process) Path() string {
+	return p.target
+}
+
+// Restart stops the process if it is running, waits for it to exit, then
+// starts it again. It fails if something else starts the process first.
 func (p *Process) Restart(ctx context.Context) error {
 	p.Stop()
 	return p.Start(ctx)
 }
+
+// SetArgs changes the arguments used the next time the process is started
+func (p *Process) SetArgs(args ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.args = args
+}
+
+// SetCapacity changes how many lines of output are kept, starting with the next start
+func (p *Process) SetCapacity(capacity int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.capacity = capacity
+}
+
+// SetDir changes the working directory used the next time the process is started
 func (p *Process) SetDir(d string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	p.dir = d
-	if p.cmd != nil {
-		p.cmd.Dir = d
+}
+
+// SetGroup puts the process in its own process group the next time it starts,
+// so signals reach the processes it starts too
+func (p *Process) SetGroup(g bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.group = g
+}
+
+// SetStop changes how Stop stops the process: it sends each signal in turn,
+// waiting up to timeout for the process to exit before sending the next. If it
+// is still running after the last one, it is killed.
+func (p *Process) SetStop(signals []syscall.Signal, timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(signals) == 0 {
+		signals = DefaultStopSignals
+	}
+	if timeout <= 0 {
+		timeout = DefaultStopTimeout
 	}
+	p.stopSignals = signals
+	p.stopTimeout = timeout
+}
+
+// SetEnv sets extra environment variables, in "KEY=value" form, that are added to
+// flogo's own environment when the process is started
+func (p *Process) SetEnv(env []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.env = env
 }
 func (p *Process) Signal(s syscall.Signal) error {
-	if p.cmd == nil {
-		return fmt.Errorf("cmd is nil")
-	}
-	return p.cmd.Process.Signal(s)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.signal(s)
 }
 func (p *Process) SignalInterrupt() {
 	p.Signal(syscall.SIGINT)
 }
+
+// SignalStop sends the first of the stop signals, without waiting for the
+// process to exit
+func (p *Process) SignalStop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state == StateRunning || p.state == StateStopping {
+		p.signalStop(p.stopSignals[0])
+	}
+}
+
+// State gets where the process is in its life
+func (p *Process) State() State {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// StopSignal gets the signal that ended the latest run: the one that killed it,
+// or the last one sent to stop it if it exited by itself after that. It is 0 if
+// the run is still going or exited without being asked to.
+func (p *Process) StopSignal() syscall.Signal {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.endSignal()
+}
+
+// Start runs the process. It fails if the process is already running.
 func (p *Process) Start(ctx context.Context) error {
-	p.Output.Reset()
-	p.Stdout.Reset()
-	p.Stderr.Reset()
+	p.mu.Lock()
+	switch p.state {
+	case StateStarting, StateRunning, StateStopping:
+		state := p.state
+		p.mu.Unlock()
+		return fmt.Errorf("Failed to start '%s': process is %s", p.target, state)
+	}
+	p.state = StateStarting
+	started := make(chan struct{})
+	defer close(started)
+	p.started = started
+	done := make(chan struct{})
+	p.done = done
+	p.exited = nil
+	p.stopSignal = 0
+	// The readers hold on to this, so they can't write into the next run's output
+	output := NewLines(p.capacity)
+	p.output = output
 	// Create the command
-	p.cmd = exec.Command(p.target, p.args...)
-
+	cmd := exec.Command(p.target, p.args...)
 	if p.dir != "" {
-		p.cmd.Dir = p.dir
+		cmd.Dir = p.dir
 	}
+	if len(p.env) > 0 {
+		cmd.Env = append(os.Environ(), p.env...)
+	}
+	group := p.group
+	if group {
+		setProcessGroup(cmd)
+	}
+	p.mu.Unlock()
+
 	// Get a pipe for stdout
-	stdout, err := p.cmd.StdoutPipe()
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		p.cmd = nil
+		p.failStart(done)
 		return errors.New("Failed to get stdout pipe")
 	}
 
 	// get stderr too
-	stderr, err := p.cmd.StderrPipe()
+	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		p.cmd = nil
+		p.failStart(done)
 		return errors.New("Failed to get stderr pipe")
 	}
 
 	// Start the command (non-blocking) and signal command start
-	if err := p.cmd.Start(); err != nil {
-		p.cmd = nil
+	if err := cmd.Start(); err != nil {
+		p.failStart(done)
 		return fmt.Errorf("Failed to start '%s': %w", p.target, err)
 	}
 	log.Debug().Str("target", p.target).Msg("started process")
-	p.isRunning = true
-	go p.OnEvent.Publish(EventProcess{
+	p.mu.Lock()
+	p.cmd = cmd
+	p.pgid = 0
+	if group {
+		p.pgid = cmd.Process.Pid
+	}
+	p.state = StateRunning
+	p.mu.Unlock()
+	p.OnEvent.Publish(EventProcess{
 		Data:         []byte{},
 		ProcessState: nil,
 		Type:         EventProcessStart,
 	})
 
-	// Read stdout line by line
-	scanner := bufio.NewScanner(stdout)
-	go func() {
-		for scanner.Scan() {
-			b := scanner.Bytes()
-			p.onStream(&p.Stdout, p.chanStdout, b)
+	// Read stdout and stderr line by line
+	var streams sync.WaitGroup
+	for stream, r := range map[Stream]io.Reader{StreamStdout: stdout, StreamStderr: stderr} {
+		c := p.chanStdout
+		if stream == StreamStderr {
+			c = p.chanStderr
 		}
-	}()
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			lr := newLineReader(
+				func(b []byte) { p.onStream(output, stream, c, b) },
+				func(b []byte) { p.onPartial(output, stream, b) },
+			)
+			if err := lr.Run(r); err != nil && !errors.Is(err, os.ErrClosed) {
+				log.Warn().Err(err).Str("target", p.target).Str("stream", stream.String()).Msg("failed to read output")
+			}
+		}()
+	}
+	go p.wait(cmd, done, &streams, stdout, stderr)
+	return nil
+}
 
-	// Read stderr line by line
-	stderrScanner := bufio.NewScanner(stderr)
-	go func() {
-		for stderrScanner.Scan() {
-			b := stderrScanner.Bytes()
-			p.onStream(&p.Stderr, p.chanStderr, b)
-		}
-	}()
+// Wait waits for the latest run to exit and gets how it went
+func (p *Process) Wait() (*os.ProcessState, error) {
+	<-p.Done()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state == StateIdle {
+		return nil, ErrNotStarted
+	}
+	return p.exited, nil
+}
 
-	// Wait for the command to finish
-	go func() {
-		s, err := p.cmd.Process.Wait()
-		if err != nil {
-			log.Warn().Err(err).Msg("Got error on cmd.Wait()")
+// Signal the process to stop, with each of the stop signals in turn until it
+// exits, then actively kill. This function does not return until the child is
+// dead. If the process has its own group, whatever is left of the group is
+// killed after it.
+func (p *Process) Stop() {
+	p.stop(nil)
+}
+
+// StopRun stops the process like Stop, but only if the run that done belongs to
+// is still the latest one. Get done from Done when deciding to stop a run, so a
+// stop that is slow to happen can't stop the run that replaced it.
+func (p *Process) StopRun(done <-chan struct{}) {
+	p.stop(done)
+}
+
+func (p *Process) stop(run <-chan struct{}) {
+	p.mu.Lock()
+	signals := p.stopSignals
+	timeout := p.stopTimeout
+	p.mu.Unlock()
+	done, pgid, ok := p.beginStop(signals[0], run)
+	if ok {
+		log.Debug().Str("target", p.target).Str("signal", SignalName(signals[0])).Msg("Begin waiting for process stop")
+		for i, is_waiting := 1, true; is_waiting; i++ {
+			select {
+			case <-done:
+				is_waiting = false
+			case <-time.After(timeout):
+				s := syscall.SIGKILL
+				if i < len(signals) {
+					s = signals[i]
+				}
+				log.Info().Str("signal", SignalName(s)).Msg("process still running, sending another signal")
+				p.sendStop(s)
+			}
 		}
-		p.isRunning = false
-		log.Debug().Str("target", p.target).Msg("ended process")
-		go p.OnEvent.Publish(EventProcess{
-			Data:         []byte{},
-			ProcessState: s,
-			Type:         EventProcessStop,
-		})
-		p.cmd = nil
-	}()
-	return nil
+		log.Debug().Str("target", p.target).Msg("Done waiting for process stop")
+	}
+	p.reapGroup(pgid)
 }
 
-// Signal the process to stop. Wait for it to complete, or for 3 seconds to pass, then
-// actively kill. This function does not return until the child is dead
-func (p *Process) Stop() {
-	if !p.isRunning {
+// Kill the process, and its group if it has one, without giving it a chance to
+// clean up. Wait for it to exit, or for 3 seconds to pass.
+func (p *Process) Kill() {
+	done, pgid, ok := p.beginStop(syscall.SIGKILL, nil)
+	if !ok {
+		p.reapGroup(pgid)
 		return
 	}
-	sub_event := p.OnEvent.Subscribe()
-	defer sub_event.Close()
+	select {
+	case <-done:
+		p.reapGroup(pgid)
+	case <-time.After(time.Second * 3):
+		log.Warn().Str("target", p.target).Msg("process still running after SIGKILL")
+	}
+}
 
-	if p.cmd != nil {
-		p.SignalInterrupt()
+// beginStop signals the process to stop, if it is running, and gets the channel
+// that is closed when it exits and the process group to clean up after it. It
+// is false when there's nothing to wait for. If run isn't nil, only the run it
+// belongs to is stopped.
+func (p *Process) beginStop(s syscall.Signal, run <-chan struct{}) (<-chan struct{}, int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.settle()
+	if run != nil && run != (<-chan struct{})(p.done) {
+		// That run is over, and its group was cleaned up when it was stopped
+		return nil, 0, false
 	}
-	is_waiting := true
-	log.Debug().Str("target", p.target).Msg("Begin waiting for process stop")
-	for is_waiting {
-		select {
-		case evt := <-sub_event.C:
-			if evt.Type == EventProcessStop {
-				is_waiting = false
-			}
-		case <-time.After(time.Second * 3):
-			if p.cmd != nil {
-				log.Info().Msg("Sent SIGKILL")
-				p.Signal(syscall.SIGKILL)
-			}
+	switch p.state {
+	case StateRunning:
+		p.state = StateStopping
+	case StateStopping:
+		// Someone else is stopping it already. Only a kill is worth sending again.
+		if s != syscall.SIGKILL {
+			return p.done, p.pgid, true
 		}
+	default:
+		return nil, p.pgid, false
+	}
+	p.signalStop(s)
+	return p.done, p.pgid, true
+}
+
+// sendStop sends another signal to stop the process, if it is still stopping
+func (p *Process) sendStop(s syscall.Signal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state == StateStopping {
+		p.signalStop(s)
+	}
+}
+
+// signalStop sends a signal to stop the process and remembers it. It must be
+// called with the lock held.
+func (p *Process) signalStop(s syscall.Signal) {
+	p.stopSignal = s
+	// It may have exited already, with its output still being read
+	err := p.signal(s)
+	if err != nil && !errors.Is(err, syscall.ESRCH) && !errors.Is(err, os.ErrProcessDone) {
+		log.Warn().Err(err).Str("target", p.target).Msg("failed to signal process")
+	}
+}
+
+// failStart goes back to idle after the process couldn't start
+func (p *Process) failStart(done chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = StateIdle
+	close(done)
+}
+
+// reapGroup kills the processes a run started that outlived it, like workers
+// or a dev server, so they don't hold on to ports. The group is the one the run
+// had, since the next run may have started by now.
+func (p *Process) reapGroup(pgid int) {
+	if pgid == 0 {
+		return
 	}
-	log.Debug().Str("target", p.target).Msg("Done waiting for process stop")
+	lingering := groupMembers(pgid)
+	if len(lingering) == 0 {
+		return
+	}
+	log.Warn().Str("target", p.target).Strs("processes", lingering).Msg("killing processes left behind by the program")
+	signalGroup(pgid, syscall.SIGKILL)
+}
+
+// settle waits until the process is done starting. It must be called with the
+// lock held, which it lets go of while waiting.
+func (p *Process) settle() {
+	for p.state == StateStarting {
+		started := p.started
+		p.mu.Unlock()
+		<-started
+		p.mu.Lock()
+	}
+}
+
+// signal sends a signal to the process, or its group. It must be called with
+// the lock held.
+func (p *Process) signal(s syscall.Signal) error {
+	if p.state != StateRunning && p.state != StateStopping {
+		return fmt.Errorf("process is %s", p.state)
+	}
+	if p.pgid != 0 {
+		return signalGroup(p.pgid, s)
+	}
+	return p.cmd.Process.Signal(s)
 }
-func (p *Process) onStream(buf *bytes.Buffer, c chan<- []byte, b []byte) {
-	buf.Write(b)
-	buf.Write([]byte("\n"))
-	p.Output.Write(b)
-	p.Output.Write([]byte("\n"))
+
+// wait waits for a run to exit, then marks it done
+func (p *Process) wait(cmd *exec.Cmd, done chan struct{}, streams *sync.WaitGroup, pipes ...io.Closer) {
+	s, err := cmd.Process.Wait()
+	if err != nil {
+		log.Warn().Err(err).Msg("Got error on cmd.Wait()")
+	}
+	// Make sure all of the output is in before saying the process stopped.
+	// Something the process started can hold the pipes open, so don't wait forever.
+	drained := make(chan struct{})
+	go func() {
+		streams.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		log.Warn().Str("target", p.target).Msg("output still open after process exit")
+	}
+	for _, pipe := range pipes {
+		pipe.Close()
+	}
+	log.Debug().Str("target", p.target).Msg("ended process")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = StateExited
+	p.exited = s
+	// Publish before letting go of the lock, so the next run can't announce
+	// its start before this one announces its stop
+	p.OnEvent.Publish(EventProcess{
+		Data:         []byte{},
+		ProcessState: s,
+		StopSignal:   p.endSignal(),
+		Type:         EventProcessStop,
+	})
+	close(done)
+}
+
+// endSignal gets the signal that ended the latest run. It must be called with
+// the lock held.
+func (p *Process) endSignal() syscall.Signal {
+	if p.exited == nil {
+		return 0
+	}
+	if ws, ok := p.exited.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return ws.Signal()
+	}
+	return p.stopSignal
+}
+func (p *Process) onStream(output *Lines, stream Stream, c chan<- []byte, b []byte) {
+	output.Append(stream, b)
 	select {
 	case c <- b:
 	default:
 	}
 
-	go p.OnEvent.Publish(EventProcess{
+	// Publish never blocks, and doing it here keeps the output of a run
+	// ahead of its stop event
+	p.OnEvent.Publish(EventProcess{
 		Data:         b,
 		ProcessState: nil,
 		Type:         EventProcessOutput,
 	})
 }
+
+// onPartial shows the start of a line while waiting for the rest of it
+func (p *Process) onPartial(output *Lines, stream Stream, b []byte) {
+	output.SetPartial(stream, b)
+	p.OnEvent.Publish(EventProcess{
+		Data:         []byte{},
+		ProcessState: nil,
+		Type:         EventProcessOutput,
+	})
+}
@@ -0,0 +1,196 @@
+//go:build unix
+
+package process
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A program that writes to both streams until it is stopped
+func newChatty() *Process {
+	p := New("sh", "-c", "i=0; while true; do echo out $i; echo err $i >&2; i=$((i+1)); sleep 0.01; done")
+	p.SetGroup(true)
+	p.SetCapacity(100)
+	return p
+}
+
+// waitDone waits for the latest run to exit, failing the test if it doesn't
+func waitDone(t *testing.T, p *Process) {
+	t.Helper()
+	select {
+	case <-p.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("process still %s after 5s", p.State())
+	}
+}
+
+func TestStartMissing(t *testing.T) {
+	p := New("./does-not-exist")
+	if err := p.Start(context.Background()); err == nil {
+		t.Fatal("starting a missing program should fail")
+	}
+	if s := p.State(); s != StateIdle {
+		t.Errorf("missing program is %s, not idle", s)
+	}
+	if _, err := p.Wait(); !errors.Is(err, ErrNotStarted) {
+		t.Errorf("waiting on a missing program got %v", err)
+	}
+	// Neither of these has anything to stop
+	p.Stop()
+	p.Kill()
+}
+
+func TestRestartInARow(t *testing.T) {
+	ctx := context.Background()
+	// Quiet, so output events can't crowd out the ones we count
+	p := New("sh", "-c", "exec sleep 10")
+	p.SetGroup(true)
+	sub := p.OnEvent.Subscribe()
+	counts := make(map[EventProcessType]int)
+	var counts_mu sync.Mutex
+	var events sync.WaitGroup
+	events.Go(func() {
+		for evt := range sub.C {
+			counts_mu.Lock()
+			counts[evt.Type]++
+			counts_mu.Unlock()
+		}
+	})
+
+	for i := range 20 {
+		if err := p.Restart(ctx); err != nil {
+			t.Fatalf("restart %d: %v", i, err)
+		}
+		if s := p.State(); s != StateRunning {
+			t.Fatalf("restart %d left the process %s", i, s)
+		}
+	}
+	if err := p.Start(ctx); err == nil {
+		t.Error("starting a running process should fail")
+	}
+	p.Stop()
+	s, err := p.Wait()
+	if err != nil || s == nil {
+		t.Errorf("waiting on a stopped process got %v, %v", s, err)
+	}
+	if s := p.State(); s != StateExited {
+		t.Errorf("stopped process is %s", s)
+	}
+
+	// The stop event is published before Done is closed
+	sub.Close()
+	events.Wait()
+	counts_mu.Lock()
+	defer counts_mu.Unlock()
+	if counts[EventProcessStart] != 20 || counts[EventProcessStop] != 20 {
+		t.Errorf("got %d starts and %d stops, want 20 of each", counts[EventProcessStart], counts[EventProcessStop])
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	ctx := context.Background()
+	p := newChatty()
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Go(func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			p.Output().Tail(10)
+			for range p.Output().All() {
+			}
+			p.State()
+			p.StopSignal()
+			p.Args()
+		}
+	})
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			for j := range 10 {
+				switch (i + j) % 5 {
+				case 0:
+					p.Start(ctx)
+				case 1:
+					p.Stop()
+				case 2:
+					p.Restart(ctx)
+				case 3:
+					p.Kill()
+				case 4:
+					select {
+					case <-p.Done():
+					case <-time.After(50 * time.Millisecond):
+					}
+				}
+			}
+		})
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	// Whatever state that left it in, it can be started and stopped
+	p.Start(ctx)
+	p.Kill()
+	waitDone(t, p)
+	if s := p.State(); s != StateExited {
+		t.Errorf("killed process is %s", s)
+	}
+}
+
+func TestStopSignal(t *testing.T) {
+	ctx := context.Background()
+	p := newChatty()
+	if err := p.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.StopSignal(); s != 0 {
+		t.Errorf("running process has stop signal %s", SignalName(s))
+	}
+	p.Kill()
+	waitDone(t, p)
+	if s := p.StopSignal(); s != syscall.SIGKILL {
+		t.Errorf("killed process was ended by %s", SignalName(s))
+	}
+
+	// A stop sequence of its own
+	p.SetStop([]syscall.Signal{syscall.SIGTERM}, 100*time.Millisecond)
+	if err := p.Restart(ctx); err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	if s := p.StopSignal(); s != syscall.SIGTERM {
+		t.Errorf("stopped process was ended by %s", SignalName(s))
+	}
+}
+
+func TestStopRunStale(t *testing.T) {
+	ctx := context.Background()
+	p := newChatty()
+	if err := p.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stale := p.Done()
+	if err := p.Restart(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// The run stale belongs to is already gone, so this leaves the new one alone
+	p.StopRun(stale)
+	if s := p.State(); s != StateRunning {
+		t.Errorf("stopping a replaced run left the process %s", s)
+	}
+	p.StopRun(p.Done())
+	if s := p.State(); s != StateExited {
+		t.Errorf("stopping the latest run left the process %s", s)
+	}
+}
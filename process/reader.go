@@ -0,0 +1,187 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// How much of a line is kept. The rest is dropped so one huge line, like a
+// JSON log entry, can't use up all our memory.
+const maxLineLength = 64 * 1024
+
+// How long to wait for the rest of a line before showing what there is, for
+// prompts and progress bars
+const partialLineDelay = 100 * time.Millisecond
+
+// lineReader splits output into lines. It reads until the stream ends, no
+// matter how long the lines are, so the program never blocks on a full pipe.
+type lineReader struct {
+	// The line so far, up to maxLineLength
+	current []byte
+	// Whether the line changed since it was last shown
+	dirty bool
+	// Whether the last chunk ended in '\r', so we don't know yet if it is
+	// "\r\n" or an overwrite
+	pendingCR bool
+	// How many bytes of the line were dropped
+	truncated int
+
+	// Called with each line, without the line ending
+	onLine func([]byte)
+	// Called with the line so far when the rest is slow to arrive
+	onPartial func([]byte)
+}
+
+func newLineReader(onLine func([]byte), onPartial func([]byte)) *lineReader {
+	return &lineReader{
+		current:   make([]byte, 0),
+		onLine:    onLine,
+		onPartial: onPartial,
+	}
+}
+
+// Run reads r until it ends, and returns the error that ended it, if it isn't EOF
+func (lr *lineReader) Run(r io.Reader) error {
+	chunks := make(chan []byte)
+	done := make(chan error, 1)
+	go func() {
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := r.Read(buf)
+			if n > 0 {
+				chunks <- buf[:n]
+			}
+			if err != nil {
+				close(chunks)
+				done <- err
+				return
+			}
+		}
+	}()
+
+	timer := time.NewTimer(partialLineDelay)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				lr.finish()
+				err := <-done
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			lr.write(chunk)
+			if lr.dirty {
+				timer.Reset(partialLineDelay)
+			} else {
+				timer.Stop()
+			}
+		case <-timer.C:
+			if lr.dirty {
+				lr.dirty = false
+				lr.onPartial(lr.line())
+			}
+		}
+	}
+}
+
+// write handles a chunk of output
+func (lr *lineReader) write(data []byte) {
+	if lr.pendingCR {
+		lr.pendingCR = false
+		if len(data) > 0 && data[0] == '\n' {
+			lr.endLine()
+			data = data[1:]
+		} else {
+			lr.overwrite()
+		}
+	}
+	for len(data) > 0 {
+		i := bytes.IndexAny(data, "\r\n")
+		if i < 0 {
+			lr.add(data)
+			return
+		}
+		lr.add(data[:i])
+		if data[i] == '\n' {
+			lr.endLine()
+			data = data[i+1:]
+			continue
+		}
+		// A '\r' starts the line over, like a terminal does for progress bars,
+		// unless it is part of a "\r\n"
+		if i+1 == len(data) {
+			lr.pendingCR = true
+			return
+		}
+		if data[i+1] == '\n' {
+			lr.endLine()
+			data = data[i+2:]
+			continue
+		}
+		lr.overwrite()
+		data = data[i+1:]
+	}
+}
+
+// add puts data on the end of the line, dropping what doesn't fit
+func (lr *lineReader) add(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	lr.dirty = true
+	// Once some of the line is dropped, drop the rest of it too. Otherwise a
+	// short chunk could fit in the room left and land after the gap, even in
+	// the middle of a character we cut.
+	if lr.truncated > 0 {
+		lr.truncated += len(data)
+		return
+	}
+	room := maxLineLength - len(lr.current)
+	if len(data) <= room {
+		lr.current = append(lr.current, data...)
+		return
+	}
+	// Don't cut a character in half
+	cut := room
+	for cut > 0 && !utf8.RuneStart(data[cut]) {
+		cut--
+	}
+	lr.current = append(lr.current, data[:cut]...)
+	lr.truncated += len(data) - cut
+}
+
+// overwrite starts the line over
+func (lr *lineReader) overwrite() {
+	lr.current = lr.current[:0]
+	lr.truncated = 0
+	lr.dirty = true
+}
+
+func (lr *lineReader) endLine() {
+	lr.onLine(lr.line())
+	lr.current = make([]byte, 0)
+	lr.dirty = false
+	lr.truncated = 0
+}
+
+// finish sends whatever is left once the stream ends
+func (lr *lineReader) finish() {
+	if len(lr.current) > 0 || lr.truncated > 0 {
+		lr.endLine()
+	}
+}
+
+// line gets the line so far, marked if some of it was dropped
+func (lr *lineReader) line() []byte {
+	if lr.truncated == 0 {
+		return lr.current
+	}
+	return fmt.Appendf(bytes.Clone(lr.current), " [flogo: %d more bytes cut]", lr.truncated)
+}
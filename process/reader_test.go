@@ -0,0 +1,109 @@
+package process
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineReaderWrite(t *testing.T) {
+	long := strings.Repeat("x", maxLineLength)
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{"lines", []string{"a\nb\n"}, []string{"a", "b"}},
+		{"line across reads", []string{"ab", "c\n"}, []string{"abc"}},
+		{"crlf", []string{"a\r\nb\r\n"}, []string{"a", "b"}},
+		{"crlf across reads", []string{"a\r", "\nb\r", "\n"}, []string{"a", "b"}},
+		{"bare cr overwrites", []string{"10%\r50%\r100%\n"}, []string{"100%"}},
+		{"bare cr at the end of a read", []string{"50%\r", "100%\n"}, []string{"100%"}},
+		{"empty line", []string{"\n\r\n"}, []string{"", ""}},
+		{"no newline at the end", []string{"a\nb"}, []string{"a", "b"}},
+		{"fits exactly", []string{long + "\n"}, []string{long}},
+		{"truncated", []string{long + "yz\n"}, []string{long + " [flogo: 2 more bytes cut]"}},
+		{"truncated across reads", []string{long, "yz", "\nnext\n"}, []string{long + " [flogo: 2 more bytes cut]", "next"}},
+		// The 'é' doesn't fit, so the 'a' that would have has to go with it
+		{"truncated in a character", []string{long[1:] + "é", "a\n"}, []string{long[1:] + " [flogo: 3 more bytes cut]"}},
+		{"truncated then overwritten", []string{long + "yz\rshort\n"}, []string{"short"}},
+		{"truncated without a newline", []string{long + "y"}, []string{long + " [flogo: 1 more bytes cut]"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]string, 0)
+			lr := newLineReader(func(b []byte) {
+				got = append(got, string(b))
+			}, func([]byte) {})
+			for _, c := range tt.chunks {
+				lr.write([]byte(c))
+			}
+			lr.finish()
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %d lines %.80q, want %d lines %.80q", len(got), got, len(tt.want), tt.want)
+			}
+		})
+	}
+}
+
+func TestLineReaderPartial(t *testing.T) {
+	r, w := io.Pipe()
+	lines := make(chan string, 10)
+	partials := make(chan string, 10)
+	lr := newLineReader(func(b []byte) {
+		lines <- string(b)
+	}, func(b []byte) {
+		partials <- string(b)
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- lr.Run(r)
+	}()
+
+	// A prompt is shown once it has been left alone for a while
+	start := time.Now()
+	w.Write([]byte("name? "))
+	select {
+	case p := <-partials:
+		if p != "name? " {
+			t.Errorf("got partial line %q", p)
+		}
+		if d := time.Since(start); d < partialLineDelay {
+			t.Errorf("partial line shown after %s, before %s", d, partialLineDelay)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("partial line never shown")
+	}
+	// and again when it changes
+	w.Write([]byte("bob"))
+	select {
+	case p := <-partials:
+		if p != "name? bob" {
+			t.Errorf("got partial line %q", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("changed partial line never shown")
+	}
+
+	// A line that ends in time is never partial
+	w.Write([]byte("\nquick"))
+	w.Write([]byte("\n"))
+	w.Close()
+	if err := <-done; err != nil {
+		t.Errorf("run got %v", err)
+	}
+	close(lines)
+	close(partials)
+	got := make([]string, 0)
+	for l := range lines {
+		got = append(got, l)
+	}
+	if want := []string{"name? bob", "quick"}; !slices.Equal(got, want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+	for p := range partials {
+		t.Errorf("got extra partial line %q", p)
+	}
+}
@@ -0,0 +1,46 @@
+package process
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How a process is stopped when nothing else is set: interrupt it, then kill
+// it if it's still running after DefaultStopTimeout
+var DefaultStopSignals = []syscall.Signal{syscall.SIGINT, syscall.SIGKILL}
+
+const DefaultStopTimeout = time.Second * 3
+
+// The signals a process can be stopped with, by name
+var signalNames = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// ParseSignal gets a signal from its name, like "SIGTERM" or "term"
+func ParseSignal(name string) (syscall.Signal, error) {
+	n := strings.ToUpper(name)
+	if !strings.HasPrefix(n, "SIG") {
+		n = "SIG" + n
+	}
+	s, ok := signalNames[n]
+	if !ok {
+		return 0, fmt.Errorf("'%s' is not one of SIGHUP, SIGINT, SIGKILL, SIGQUIT or SIGTERM", name)
+	}
+	return s, nil
+}
+
+// SignalName gets the name of a signal, like "SIGTERM"
+func SignalName(s syscall.Signal) string {
+	for name, sig := range signalNames {
+		if sig == s {
+			return name
+		}
+	}
+	return s.String()
+}
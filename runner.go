@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
+	"slices"
+	"syscall"
+	"time"
 
 	"github.com/Gleipnir-Technology/flogo/process"
 	"github.com/Gleipnir-Technology/flogo/state"
@@ -18,6 +20,7 @@ type EventRunnerType int
 
 const (
 	EventRunnerOutput EventRunnerType = iota
+	EventRunnerReady
 	EventRunnerStart
 	EventRunnerStopOK
 	EventRunnerStopErr
@@ -25,72 +28,230 @@ const (
 )
 
 type EventRunner struct {
+	// The new line of output, for EventRunnerOutput
+	Line    []byte
 	Process *state.Process
 	Type    EventRunnerType
+	// Where the process that became ready is listening, for EventRunnerReady
+	Upstream url.URL
 }
+type RunnerMode int
+
+const (
+	// Start the new process on the alternate upstream and only stop the old one once the new one is ready
+	RunnerModeBlueGreen RunnerMode = iota
+	// Stop the old process, then start the new one
+	RunnerModeRestart
+)
+
 type Runner struct {
+	// Where the process listens every other restart in blue/green mode
+	AlternateUpstream url.URL
+	// Arguments to pass to the process
+	Args      []string
 	DoRestart <-chan struct{}
-	OnEvent   chan<- EventRunner
-	Target    string
+	// Extra environment variables for the process, in "KEY=value" form
+	Env  []string
+	Mode RunnerMode
+	// The environment variable that tells the process which port to listen on in blue/green mode
+	PortEnv string
+	OnEvent chan<- EventRunner
+	// The absolute path to the binary to run
+	Output string
+	// How many lines of output to keep
+	OutputLines int
+	// An HTTP path that must respond before the process is considered ready. If
+	// empty the process is ready as soon as it accepts connections.
+	ReadyPath string
+	// How long to wait for the process to be ready
+	ReadyTimeout time.Duration
+	// The signals that stop the process, in order, and how long to wait after each
+	StopSignals []syscall.Signal
+	StopTimeout time.Duration
+	Target      string
+	// The address the process will listen on once it is ready
+	Upstream url.URL
+}
+
+// runnerSlot is one copy of the process. There are two in blue/green mode so
+// that one can keep serving while the other starts.
+type runnerSlot struct {
+	// Cancels waiting for the process to be ready
+	cancelReady context.CancelFunc
+	process     *process.Process
+	sub         *process.Subscription[process.EventProcess]
+	upstream    url.URL
+}
+
+// runnerReady is the result of waiting for the process in a slot to be ready
+type runnerReady struct {
+	ok   bool
+	slot int
 }
 
 func (r *Runner) Run(ctx context.Context) error {
 	logger := log.Ctx(ctx).With().Caller().Logger()
 	logger.Info().Msg("Started runner loop")
-	build_output, err := determineBuildOutputAbs(r.Target)
-	if err != nil {
-		return fmt.Errorf("Failed to determine build output name: %v", err)
-	}
+	build_output := r.Output
 	base := filepath.Base(build_output)
 	logger.Info().Str("target", build_output).Msg("Build output")
-	p := process.New(build_output)
+	slots := r.newSlots()
 	// Avoid infinite recursion when we self-host
 	if base == "flogo" {
+		p := slots[0].process
 		logger.Info().Msg("Refusing to infinitely recurse on flogo")
-		r.onStart(logger)
+		r.onStart(logger, p)
 		r.onOutput(logger, []byte("no flogo recursing"), p)
 		return nil
 	}
-	sub_event := p.OnEvent.Subscribe()
-	defer sub_event.Close()
+	for _, slot := range slots {
+		slot.sub = slot.process.OnEvent.Subscribe()
+		defer slot.sub.Close()
+		defer func() { slot.cancelReady() }()
+	}
+	// The slot whose output we show
+	current := 0
+	// The slot the proxy is sending requests to
+	serving := 0
+	chanReady := make(chan runnerReady)
 	// Start runner by starting the command, if we can
-	err = p.Start(ctx)
+	err := slots[current].process.Start(ctx)
 	if err != nil {
 		if os.IsNotExist(err) {
 			logger.Info().Err(err).Msg("Runner process does not exist, waiting for it to be built")
 			r.onWaiting()
 		}
 		logger.Warn().Err(err).Msg("failed to start runner process")
+	} else {
+		r.runStarted(ctx, logger, slots[current], current, chanReady)
 	}
 	logger.Debug().Msg("Triggered initial runner process")
 	for {
+		var evt process.EventProcess
+		var i int
 		select {
 		case <-ctx.Done():
 			logger.Info().Msg("Context done, exiting runner")
-			p.SignalInterrupt()
-			return nil
-		case evt := <-sub_event.C:
-			switch evt.Type {
-			case process.EventProcessOutput:
-				go r.onOutput(logger, evt.Data, p)
-			case process.EventProcessStart:
-				go r.onStart(logger)
-			case process.EventProcessStop:
-				go r.onExit(logger, p, evt.ProcessState)
-			default:
-				logger.Warn().Msg("unrecognized process event")
+			for _, slot := range slots {
+				slot.process.SignalStop()
 			}
+			return nil
+		case evt = <-slots[0].sub.C:
+			i = 0
+		case evt = <-slots[len(slots)-1].sub.C:
+			i = len(slots) - 1
+		case ready := <-chanReady:
+			r.handleReady(logger, slots, ready, &serving)
+			continue
 		case <-r.DoRestart:
+			if r.Mode == RunnerModeBlueGreen {
+				current = (serving + 1) % len(slots)
+				logger.Info().Int("slot", current).Msg("Restart signal received, starting new process alongside the old one...")
+				slot := slots[current]
+				slot.process.Stop()
+				err := slot.process.Start(ctx)
+				if err != nil {
+					return fmt.Errorf("runner start err: %w", err)
+				}
+				r.runStarted(ctx, logger, slot, current, chanReady)
+				continue
+			}
 			logger.Info().Msg("Restart signal received, restarting process...")
-			err := p.Restart(ctx)
+			err := slots[current].process.Restart(ctx)
 			if err != nil {
 				return fmt.Errorf("runner restart err: %w", err)
 			}
+			r.runStarted(ctx, logger, slots[current], current, chanReady)
+			continue
+		}
+		slot := slots[i]
+		p := slot.process
+		switch evt.Type {
+		case process.EventProcessOutput:
+			if i == current {
+				go r.onOutput(logger, evt.Data, p)
+			}
+		case process.EventProcessStart:
+			// Handled by runStarted once the start returns
+		case process.EventProcessStop:
+			// The stop of a run that was replaced while we weren't reading
+			// doesn't end the wait for the run that replaced it
+			if p.State() != process.StateRunning {
+				slot.cancelReady()
+			}
+			// The old process stopping after a blue/green switch isn't news
+			if i == current {
+				go r.onExit(logger, p, evt.ProcessState, evt.StopSignal)
+			}
+		default:
+			logger.Warn().Msg("unrecognized process event")
+		}
+	}
+}
+
+// runStarted reports the run that just started in a slot, which becomes the
+// one we show, and waits for it to be ready. It's called when the start returns
+// rather than on the start event, which is dropped if the old run's output
+// fills the subscription while we restart.
+func (r *Runner) runStarted(ctx context.Context, logger zerolog.Logger, slot *runnerSlot, i int, chanReady chan<- runnerReady) {
+	slot.cancelReady()
+	slot.cancelReady = r.startWaitReady(ctx, logger, i, slot.upstream, chanReady)
+	go r.onStart(logger, slot.process)
+}
+
+// handleReady deals with a process becoming ready, or failing to
+func (r *Runner) handleReady(logger zerolog.Logger, slots []*runnerSlot, ready runnerReady, serving *int) {
+	slot := slots[ready.slot]
+	if !ready.ok {
+		logger.Warn().Int("slot", ready.slot).Dur("timeout", r.ReadyTimeout).Msg("runner not ready in time")
+		// Give up on the new process and leave the old one serving
+		if ready.slot != *serving {
+			done := slot.process.Done()
+			go slot.process.StopRun(done)
 		}
+		return
+	}
+	logger.Debug().Str("upstream", slot.upstream.String()).Msg("runner ready")
+	go r.onReady(logger, slot.upstream)
+	previous := *serving
+	*serving = ready.slot
+	if previous != ready.slot {
+		logger.Info().Int("slot", previous).Msg("stopping previous process")
+		// Only stop the run that was serving, in case the slot is restarted
+		// before the stop gets going
+		done := slots[previous].process.Done()
+		go slots[previous].process.StopRun(done)
 	}
 }
 
-func (r *Runner) onExit(logger zerolog.Logger, p *process.Process, s *os.ProcessState) {
+// newSlots creates the processes we switch between
+func (r *Runner) newSlots() []*runnerSlot {
+	upstreams := []url.URL{r.Upstream}
+	if r.Mode == RunnerModeBlueGreen {
+		upstreams = append(upstreams, r.AlternateUpstream)
+	}
+	result := make([]*runnerSlot, len(upstreams))
+	for i, u := range upstreams {
+		p := process.New(r.Output, r.Args...)
+		env := r.Env
+		if r.Mode == RunnerModeBlueGreen {
+			env = append(slices.Clone(r.Env), r.PortEnv+"="+upstreamPort(u))
+		}
+		p.SetEnv(env)
+		p.SetCapacity(r.OutputLines)
+		// Stopping the program stops the workers and dev servers it started too
+		p.SetGroup(true)
+		p.SetStop(r.StopSignals, r.StopTimeout)
+		result[i] = &runnerSlot{
+			cancelReady: func() {},
+			process:     p,
+			upstream:    u,
+		}
+	}
+	return result
+}
+
+func (r *Runner) onExit(logger zerolog.Logger, p *process.Process, s *os.ProcessState, stop_signal syscall.Signal) {
 	var t EventRunnerType
 	i := s.ExitCode()
 	if i == 0 {
@@ -98,34 +259,43 @@ func (r *Runner) onExit(logger zerolog.Logger, p *process.Process, s *os.Process
 	} else {
 		t = EventRunnerStopErr
 	}
+	ps := newStateProcess(p, &i)
+	ps.StopSignal = signalName(stop_signal)
 	r.OnEvent <- EventRunner{
-		Process: &state.Process{
-			ExitCode: &i,
-			Output:   p.Output.Bytes(),
-			Stderr:   p.Stderr.Bytes(),
-			Stdout:   p.Stdout.Bytes(),
-		},
-		Type: t,
+		Process: ps,
+		Type:    t,
+	}
+}
+
+// signalName gets the name of the signal that ended a process, or an empty
+// string if it exited by itself
+func signalName(s syscall.Signal) string {
+	if s == 0 {
+		return ""
 	}
+	return process.SignalName(s)
 }
 func (r *Runner) onOutput(logger zerolog.Logger, b []byte, p *process.Process) {
 	logger.Debug().Bytes("b", b).Msg("subprocess output")
 	r.OnEvent <- EventRunner{
-		Process: &state.Process{
-			ExitCode: nil,
-			Output:   p.Output.Bytes(),
-			Stderr:   p.Stderr.Bytes(),
-			Stdout:   p.Stdout.Bytes(),
-		},
-		Type: EventRunnerOutput,
+		Line:    b,
+		Process: newStateProcess(p, nil),
+		Type:    EventRunnerOutput,
 	}
 }
-func (r *Runner) onStart(logger zerolog.Logger) {
+func (r *Runner) onStart(logger zerolog.Logger, p *process.Process) {
 	r.OnEvent <- EventRunner{
-		Process: nil,
+		Process: newStateProcess(p, nil),
 		Type:    EventRunnerStart,
 	}
 }
+func (r *Runner) onReady(logger zerolog.Logger, upstream url.URL) {
+	r.OnEvent <- EventRunner{
+		Process:  nil,
+		Type:     EventRunnerReady,
+		Upstream: upstream,
+	}
+}
 func (r *Runner) onWaiting() {
 	r.OnEvent <- EventRunner{
 		Process: nil,
@@ -133,40 +303,35 @@ func (r *Runner) onWaiting() {
 	}
 }
 
-// determineBuildOutputName determines the build output name from the go.mod file
-func determineBuildOutputAbs(target string) (string, error) {
-	abs, err := filepath.Abs(target)
-	if err != nil {
-		return "", fmt.Errorf("Failed to get abs path: %w", err)
-	}
-	// Check if we're in a Go module
-	go_mod_path := filepath.Join(".", "go.mod")
-	if _, err := os.Stat(go_mod_path); os.IsNotExist(err) {
-		return "", fmt.Errorf("no go.mod file found, not in a Go module")
+// newStateProcess describes the process for the rest of flogo. The output
+// isn't copied, the latest lines are read from the process's buffers.
+func newStateProcess(p *process.Process, exit_code *int) *state.Process {
+	return &state.Process{
+		Args:     p.Args(),
+		Env:      p.Env(),
+		ExitCode: exit_code,
+		Output:   p.Output(),
+		Path:     p.Path(),
 	}
+}
 
-	// Use go list to get the module name
-	args := []string{"list", "-f", "{{.Name}}", "./" + target}
-	cmd := exec.Command("go", args...)
-	output, err := cmd.Output()
-	if err != nil {
-		full_cmd := "go " + strings.Join(args, " ")
-		if ex, ok := err.(*exec.ExitError); ok {
-			return "", fmt.Errorf("Failed to run '%s': %s, %w", full_cmd, string(ex.Stderr), ex)
-		} else {
-			return "", fmt.Errorf("Failed to run '%s': %w", full_cmd, err)
+// startWaitReady reports on chanReady once the process in the slot passes the
+// readiness check, or fails to in time. The returned function abandons the wait.
+func (r *Runner) startWaitReady(ctx context.Context, logger zerolog.Logger, slot int, upstream url.URL, chanReady chan<- runnerReady) context.CancelFunc {
+	wait_ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ready_ctx, cancel_timeout := context.WithTimeout(wait_ctx, r.ReadyTimeout)
+		defer cancel_timeout()
+		ok := waitForUpstream(ready_ctx, upstream, r.ReadyPath)
+		// Nobody cares if the process stopped or we are shutting down
+		if wait_ctx.Err() != nil {
+			logger.Debug().Msg("gave up waiting for runner to be ready")
+			return
 		}
-	}
-
-	// Extract the last part of the module path
-	module := strings.TrimSpace(string(output))
-	if module == "main" {
-		// For the special name "main" we use the parent directory name
-		// since that's what 'go build' will do
-		base := filepath.Base(abs)
-		// We then re-add that base to get the full abs path to the build output
-		full := filepath.Join(abs, base)
-		return full, nil
-	}
-	return "", fmt.Errorf("Not sure what to do with '%s': this isn't implemented yet", module)
+		select {
+		case chanReady <- runnerReady{ok: ok, slot: slot}:
+		case <-wait_ctx.Done():
+		}
+	}()
+	return cancel
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// buildSources is the set of local files that go into the binary, according
+// to 'go list -deps'. It changes as imports change, so it is refreshed after
+// each build.
+type buildSources struct {
+	pkg    string
+	tags   []string
+	target string
+
+	mu sync.RWMutex
+	// Whether every package could be loaded. If not, the set may be missing
+	// packages and every Go file counts.
+	complete bool
+	// The import path of the package in each directory
+	dirs map[string]string
+	// Files that go:embed directives put into the binary
+	embedded map[string]bool
+	// The import path of the package each source file is in
+	files map[string]string
+	// Go files in the packages that build constraints exclude
+	ignored map[string]bool
+}
+
+func newBuildSources(target string, pkg string, tags []string) *buildSources {
+	return &buildSources{
+		pkg:    pkg,
+		tags:   tags,
+		target: target,
+	}
+}
+
+// Refresh lists the packages the binary is built from again
+func (s *buildSources) Refresh() error {
+	args := []string{"-deps"}
+	if len(s.tags) > 0 {
+		args = append(args, "-tags", strings.Join(s.tags, ","))
+	}
+	packages, err := goList(s.target, append(args, s.pkg)...)
+	if err != nil {
+		s.mu.Lock()
+		s.complete = false
+		s.mu.Unlock()
+		return err
+	}
+	complete := true
+	dirs := make(map[string]string)
+	embedded := make(map[string]bool)
+	files := make(map[string]string)
+	ignored := make(map[string]bool)
+	for _, p := range packages {
+		// A missing import has no directory, and may be about to be created
+		if p.Error != nil && p.Dir == "" {
+			complete = false
+		}
+		if !p.IsLocal() || p.Dir == "" {
+			continue
+		}
+		dirs[p.Dir] = p.ImportPath
+		for _, f := range p.SourceFiles() {
+			files[f] = p.ImportPath
+		}
+		for _, f := range p.EmbedFiles {
+			embedded[filepath.Join(p.Dir, f)] = true
+		}
+		for _, f := range p.IgnoredGoFiles {
+			ignored[filepath.Join(p.Dir, f)] = true
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.complete = complete
+	s.dirs = dirs
+	s.embedded = embedded
+	s.files = files
+	s.ignored = ignored
+	return nil
+}
+
+// Removes decides whether removing a directory changes the binary, because a
+// package in the build or a file it embeds is in it or below it, and why
+func (s *buildSources) Removes(dir string) (bool, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.complete {
+		return true, "the packages in the build are unknown until it succeeds"
+	}
+	for d, p := range s.dirs {
+		if isWithin(dir, d) {
+			return true, "package " + p + " is in it"
+		}
+	}
+	for f := range s.embedded {
+		if isWithin(dir, f) {
+			return true, "embedded file " + f + " is in it"
+		}
+	}
+	return false, "no package in the build is in it"
+}
+
+// IsEmbedded is true when a go:embed directive puts the file into the binary
+func (s *buildSources) IsEmbedded(path string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.embedded[path]
+}
+
+// Affects decides whether a change to the Go file changes the binary, and why
+func (s *buildSources) Affects(path string) (bool, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.complete {
+		return true, "the packages in the build are unknown until it succeeds"
+	}
+	if p, ok := s.files[path]; ok {
+		return true, "in package " + p
+	}
+	// A new file in a package we build is probably part of it, and a file
+	// excluded by build constraints may have just changed its build line.
+	// Either way the next build corrects the set.
+	if p, ok := s.dirs[filepath.Dir(path)]; ok {
+		if s.ignored[path] {
+			return true, "excluded by build constraints in package " + p + ", which may have changed"
+		}
+		return true, "new file in package " + p
+	}
+	if s.ignored[path] {
+		return false, "excluded by build constraints"
+	}
+	return false, "not imported by the main package"
+}
@@ -4,36 +4,48 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"time"
 
+	"github.com/Gleipnir-Technology/flogo/process"
 	"github.com/Gleipnir-Technology/flogo/state"
 	"github.com/Gleipnir-Technology/flogo/ui"
 	"github.com/rs/zerolog"
 )
 
 type flogoStateManager struct {
+	chanDoAnalyzer  chan struct{}
 	chanDoBuilder   chan string
 	chanDoRunner    chan struct{}
+	chanDoTester    chan string
 	chanDoUI        chan *state.Flogo
 	chanDoWebserver chan *state.Flogo
+	chanDoWebpage   chan MessageSSE
+	chanOnAnalyzer  chan EventAnalyzer
 	chanOnBuilder   chan EventBuilder
 	chanOnRunner    chan EventRunner
+	chanOnTester    chan EventTester
 	chanOnUI        chan ui.Event
-	chanOnWatcher   chan string
+	chanOnWatcher   chan EventWatcher
 	isRunning       bool
+	sources         *buildSources
 	state           *state.Flogo
+	webserver       *Webserver
 }
 
 func newFlogoStateManager() flogoStateManager {
 	return flogoStateManager{
+		chanDoAnalyzer:  make(chan struct{}),
 		chanDoBuilder:   make(chan string),
 		chanDoRunner:    make(chan struct{}),
+		chanDoTester:    make(chan string),
 		chanDoUI:        make(chan *state.Flogo),
 		chanDoWebserver: make(chan *state.Flogo),
+		chanDoWebpage:   make(chan MessageSSE),
+		chanOnAnalyzer:  make(chan EventAnalyzer),
 		chanOnBuilder:   make(chan EventBuilder),
 		chanOnRunner:    make(chan EventRunner),
+		chanOnTester:    make(chan EventTester),
 		chanOnUI:        make(chan ui.Event),
-		chanOnWatcher:   make(chan string),
+		chanOnWatcher:   make(chan EventWatcher),
 		isRunning:       true,
 		state: &state.Flogo{
 			Builder: &state.Builder{
@@ -45,12 +57,13 @@ func newFlogoStateManager() flogoStateManager {
 				RunPrevious: nil,
 				RunCurrent:  nil,
 				Status:      state.StatusRunnerWaiting,
+				Upstream:    "",
 			},
 		},
 	}
 }
 
-func (mgr *flogoStateManager) Run(root_logger zerolog.Logger, u ui.UI, bind string, target string) error {
+func (mgr *flogoStateManager) Run(root_logger zerolog.Logger, u ui.UI, cfg *Config) error {
 	// Create a context that we can cancel for signaling all goroutines to clean up
 	logger := root_logger.With().Caller().Logger()
 	ctx, cancel := context.WithCancel(root_logger.With().Logger().WithContext(context.Background()))
@@ -67,10 +80,11 @@ func (mgr *flogoStateManager) Run(root_logger zerolog.Logger, u ui.UI, bind stri
 	defer u.Close()
 
 	// Create channels for goroutine comms
-	watcher := Watcher{
-		OnEvent: mgr.chanOnWatcher,
-		Target:  target,
+	watcher, err := cfg.NewWatcher(mgr.chanOnWatcher)
+	if err != nil {
+		return err
 	}
+	mgr.sources = watcher.Sources
 	go func() {
 		err := watcher.Run(ctx)
 		if err != nil {
@@ -79,11 +93,24 @@ func (mgr *flogoStateManager) Run(root_logger zerolog.Logger, u ui.UI, bind stri
 		}
 	}()
 
+	build_output := cfg.BuildOutputAbs()
 	builder := Builder{
-		Debounce: time.Millisecond * 300,
-		OnEvent:  mgr.chanOnBuilder,
-		Target:   target,
-		ToBuild:  mgr.chanDoBuilder,
+		CacheDir:    cfg.BuildCacheDir(),
+		Command:     cfg.BuildCommand,
+		Debounce:    cfg.Debounce,
+		OnEvent:     mgr.chanOnBuilder,
+		Output:      build_output,
+		PostBuild:   cfg.Build.Post,
+		PreBuild:    cfg.Build.Pre,
+		StopSignals: cfg.Build.Stop.ParsedSignals(),
+		StopTimeout: cfg.Build.Stop.Timeout,
+		Target:      cfg.Target,
+		ToBuild:     mgr.chanDoBuilder,
+	}
+	// We can only tell what goes into the build when we run 'go build' ourselves,
+	// and pre-build hooks can generate code from anything
+	if len(cfg.Build.Command) == 0 && len(cfg.Build.Pre) == 0 {
+		builder.Fingerprint = cfg.BuildFingerprint
 	}
 	go func() {
 		err := builder.Run(ctx)
@@ -93,9 +120,23 @@ func (mgr *flogoStateManager) Run(root_logger zerolog.Logger, u ui.UI, bind stri
 		}
 	}()
 	runner := Runner{
-		DoRestart: mgr.chanDoRunner,
-		OnEvent:   mgr.chanOnRunner,
-		Target:    target,
+		Args:         cfg.Run.Args,
+		DoRestart:    mgr.chanDoRunner,
+		Env:          cfg.RunEnv(),
+		Mode:         cfg.RunnerMode(),
+		OnEvent:      mgr.chanOnRunner,
+		Output:       build_output,
+		OutputLines:  cfg.Run.OutputLines,
+		PortEnv:      cfg.Run.PortEnv,
+		ReadyPath:    cfg.Run.Ready.Path,
+		ReadyTimeout: cfg.Run.Ready.Timeout,
+		StopSignals:  cfg.Run.Stop.ParsedSignals(),
+		StopTimeout:  cfg.Run.Stop.Timeout,
+		Target:       cfg.Target,
+		Upstream:     *cfg.UpstreamURL,
+	}
+	if cfg.AlternateUpstreamURL != nil {
+		runner.AlternateUpstream = *cfg.AlternateUpstreamURL
 	}
 	go func() {
 		err := runner.Run(ctx)
@@ -105,10 +146,57 @@ func (mgr *flogoStateManager) Run(root_logger zerolog.Logger, u ui.UI, bind stri
 		}
 	}()
 
+	if cfg.Analyze.Enabled {
+		mgr.state.Analyzer = &state.Analyzer{
+			AnalyzeCurrent: nil,
+			Diagnostics:    []*state.Diagnostic{},
+			Status:         state.StatusAnalyzerIdle,
+		}
+		analyzer := Analyzer{
+			Commands:  cfg.AnalyzeCommands(),
+			OnEvent:   mgr.chanOnAnalyzer,
+			Target:    cfg.Target,
+			ToAnalyze: mgr.chanDoAnalyzer,
+		}
+		go func() {
+			err := analyzer.Run(ctx)
+			if err != nil {
+				logger.Error().Err(err).Msg("analyzer died")
+				os.Exit(16)
+			}
+		}()
+	}
+	if cfg.Test.Enabled {
+		mgr.state.Tester = &state.Tester{
+			Packages:    []string{},
+			Results:     []*state.TestResult{},
+			Status:      state.StatusTesterIdle,
+			TestCurrent: nil,
+		}
+		tester := Tester{
+			Args:        cfg.Test.Args,
+			Debounce:    cfg.Debounce,
+			OnEvent:     mgr.chanOnTester,
+			StopSignals: cfg.Test.Stop.ParsedSignals(),
+			StopTimeout: cfg.Test.Stop.Timeout,
+			Tags:        cfg.Build.Tags,
+			Target:      cfg.Target,
+			ToTest:      mgr.chanDoTester,
+		}
+		go func() {
+			err := tester.Run(ctx)
+			if err != nil {
+				logger.Error().Err(err).Msg("tester died")
+				os.Exit(15)
+			}
+		}()
+	}
+
 	// Start the web server
 	ws := NewWebserver()
+	mgr.webserver = ws
 	go func() {
-		err := ws.Run(ctx, mgr.chanDoWebserver, bind, *upstreamURL)
+		err := ws.Run(ctx, mgr.chanDoWebserver, mgr.chanDoWebpage, cfg.Bind, *cfg.UpstreamURL)
 		if err != nil {
 			logger.Error().Err(err).Msg("webserver died")
 			os.Exit(13)
@@ -117,16 +205,20 @@ func (mgr *flogoStateManager) Run(root_logger zerolog.Logger, u ui.UI, bind stri
 
 	for mgr.isRunning {
 		select {
-		case f := <-mgr.chanOnWatcher:
-			go func() {
-				mgr.chanDoBuilder <- f
-			}()
+		case evt := <-mgr.chanOnWatcher:
+			mgr.handleEventWatcher(logger, evt)
 		case evt := <-mgr.chanOnBuilder:
 			mgr.handleEventBuilder(logger, evt)
 			go mgr.sendUpdates(mgr.state)
 		case evt := <-mgr.chanOnRunner:
 			mgr.handleEventRunner(logger, evt)
 			go mgr.sendUpdates(mgr.state)
+		case evt := <-mgr.chanOnAnalyzer:
+			mgr.handleEventAnalyzer(logger, evt)
+			go mgr.sendUpdates(mgr.state)
+		case evt := <-mgr.chanOnTester:
+			mgr.handleEventTester(logger, evt)
+			go mgr.sendUpdates(mgr.state)
 		case evt := <-mgr.chanOnUI:
 			mgr.handleEventUI(logger, u, evt)
 		}
@@ -150,19 +242,47 @@ func (mgr *flogoStateManager) debugState(logger zerolog.Logger) {
 		if p.ExitCode != nil {
 			status = fmt.Sprintf("%d", *p.ExitCode)
 		}
+		if p.StopSignal != "" {
+			status += " " + p.StopSignal
+		}
 		logger.Info().
 			Str("proc", k).
 			Str("status", status).
-			Bytes("output", p.Output).
-			Bytes("stderr", p.Stderr).
-			Bytes("stdout", p.Stdout).
+			Bytes("stderr", p.Output.StreamBytes(process.StreamStderr)).
+			Bytes("stdout", p.Output.StreamBytes(process.StreamStdout)).
 			Send()
 
 	}
 
 }
+func (mgr *flogoStateManager) handleEventAnalyzer(logger zerolog.Logger, evt EventAnalyzer) {
+	a := mgr.state.Analyzer
+	switch evt.Type {
+	case EventAnalyzeDone:
+		logger.Debug().Int("diagnostics", len(evt.Diagnostics)).Msg("analyze done")
+		a.Status = state.StatusAnalyzerOK
+		if len(evt.Diagnostics) > 0 {
+			a.Status = state.StatusAnalyzerWarnings
+		}
+	case EventAnalyzeFailure:
+		logger.Debug().Msg("analyze failure")
+		a.Status = state.StatusAnalyzerFailed
+	case EventAnalyzeStart:
+		logger.Debug().Msg("analyze start")
+		a.Status = state.StatusAnalyzerRunning
+	default:
+		logger.Debug().Msg("analyze unknown")
+		return
+	}
+	a.AnalyzeCurrent = evt.Process
+	a.Diagnostics = evt.Diagnostics
+}
 func (mgr *flogoStateManager) handleEventBuilder(logger zerolog.Logger, evt EventBuilder) {
 	switch evt.Type {
+	case EventBuildCancelled:
+		logger.Debug().Msg("build cancelled")
+		mgr.state.Builder.Status = state.StatusBuilderCancelled
+		mgr.state.Builder.BuildCurrent = evt.Process
 	case EventBuildOutput:
 		//logger.Debug().Msg("build output")
 		mgr.state.Builder.BuildCurrent = evt.Process
@@ -170,6 +290,7 @@ func (mgr *flogoStateManager) handleEventBuilder(logger zerolog.Logger, evt Even
 		logger.Debug().Msg("build failure")
 		mgr.state.Builder.Status = state.StatusBuilderFailed
 		mgr.state.Builder.BuildCurrent = evt.Process
+		go mgr.refreshSources(logger)
 	case EventBuildStart:
 		logger.Debug().Msg("build start")
 		mgr.state.Builder.Status = state.StatusBuilderCompiling
@@ -178,7 +299,12 @@ func (mgr *flogoStateManager) handleEventBuilder(logger zerolog.Logger, evt Even
 		logger.Debug().Msg("build success")
 		mgr.state.Builder.Status = state.StatusBuilderOK
 		mgr.state.Builder.BuildCurrent = evt.Process
+		go mgr.refreshSources(logger)
 		go mgr.sendRunnerRestart()
+		mgr.sendAnalyzer()
+	case EventBuildUpToDate:
+		logger.Debug().Msg("build up to date")
+		mgr.state.Builder.Status = state.StatusBuilderUpToDate
 	default:
 		logger.Debug().Msg("build unknown")
 	}
@@ -188,25 +314,27 @@ func (mgr *flogoStateManager) handleEventRunner(logger zerolog.Logger, evt Event
 	case EventRunnerOutput:
 		mgr.state.Runner.RunCurrent = evt.Process
 		//logger.Debug().Msg("runner output")
-		p := evt.Process
-		logger.Debug().
-			//Bytes("output", p.Output).
-			Bytes("stderr", p.Stderr).
-			Bytes("stdout", p.Stdout).
-			Send()
+		logger.Debug().Bytes("line", evt.Line).Msg("runner output")
 		//mgr.debugState(logger)
+	case EventRunnerReady:
+		logger.Debug().Str("upstream", evt.Upstream.String()).Msg("runner ready")
+		mgr.state.Runner.Upstream = evt.Upstream.String()
+		mgr.webserver.SetUpstream(evt.Upstream)
+		go mgr.sendWebpage(newMessageReload())
 	case EventRunnerStart:
 		logger.Debug().Msg("runner start")
 		mgr.state.Runner.Status = state.StatusRunnerRunning
+		// Output from the new run can get here first
+		if !sameRun(mgr.state.Runner.RunCurrent, evt.Process) {
+			mgr.state.Runner.RunPrevious = mgr.state.Runner.RunCurrent
+		}
 		mgr.state.Runner.RunCurrent = evt.Process
 	case EventRunnerStopOK:
-		logger.Debug().Msg("runner stop ok")
-		mgr.state.Runner.Status = state.StatusRunnerStopOK
-		mgr.state.Runner.RunPrevious = mgr.state.Runner.RunCurrent
+		logger.Debug().Str("signal", evt.Process.StopSignal).Msg("runner stop ok")
+		mgr.runnerStopped(evt.Process, state.StatusRunnerStopOK)
 	case EventRunnerStopErr:
-		logger.Debug().Msg("runner stop err")
-		mgr.state.Runner.Status = state.StatusRunnerStopErr
-		mgr.state.Runner.RunPrevious = mgr.state.Runner.RunCurrent
+		logger.Debug().Str("signal", evt.Process.StopSignal).Msg("runner stop err")
+		mgr.runnerStopped(evt.Process, state.StatusRunnerStopErr)
 	case EventRunnerWaiting:
 		logger.Debug().Msg("runner waiting")
 		mgr.state.Runner.Status = state.StatusRunnerWaiting
@@ -214,6 +342,49 @@ func (mgr *flogoStateManager) handleEventRunner(logger zerolog.Logger, evt Event
 		logger.Debug().Msg("runner unknown")
 	}
 }
+
+// runnerStopped records how a run ended. A restart can report the old run
+// stopping after the new one started, in which case it's the previous run.
+func (mgr *flogoStateManager) runnerStopped(p *state.Process, status state.StatusRunner) {
+	r := mgr.state.Runner
+	if r.RunCurrent != nil && !sameRun(r.RunCurrent, p) {
+		r.RunPrevious = p
+		return
+	}
+	r.Status = status
+	r.RunCurrent = p
+}
+
+// sameRun decides whether two descriptions are of the same run, which has its
+// own output
+func sameRun(a *state.Process, b *state.Process) bool {
+	return a != nil && b != nil && a.Output == b.Output
+}
+func (mgr *flogoStateManager) handleEventTester(logger zerolog.Logger, evt EventTester) {
+	t := mgr.state.Tester
+	switch evt.Type {
+	case EventTestFailure:
+		logger.Debug().Msg("test failure")
+		t.Status = state.StatusTesterFailed
+	case EventTestOutput:
+		// A stopped run can still be reporting after the next one started
+		if t.Status != state.StatusTesterRunning {
+			return
+		}
+	case EventTestStart:
+		logger.Debug().Strs("packages", evt.Packages).Msg("test start")
+		t.Status = state.StatusTesterRunning
+	case EventTestSuccess:
+		logger.Debug().Msg("test success")
+		t.Status = state.StatusTesterOK
+	default:
+		logger.Debug().Msg("test unknown")
+		return
+	}
+	t.Packages = evt.Packages
+	t.Results = evt.Results
+	t.TestCurrent = evt.Process
+}
 func (mgr *flogoStateManager) handleEventUI(logger zerolog.Logger, u ui.UI, evt ui.Event) {
 	switch evt.Type {
 	case ui.EventDebug:
@@ -226,9 +397,55 @@ func (mgr *flogoStateManager) handleEventUI(logger zerolog.Logger, u ui.UI, evt
 		go mgr.sendUpdates(mgr.state)
 	}
 }
+func (mgr *flogoStateManager) handleEventWatcher(logger zerolog.Logger, evt EventWatcher) {
+	switch evt.Type {
+	case EventWatcherAsset:
+		logger.Debug().Str("path", evt.Rel).Msg("asset changed")
+		go mgr.sendWebpage(newMessageAssetChanged("/" + evt.Rel))
+	case EventWatcherSource:
+		go func() {
+			mgr.chanDoBuilder <- evt.Path
+		}()
+		mgr.sendTester(evt.Path)
+	case EventWatcherTest:
+		mgr.sendTester(evt.Path)
+	default:
+		logger.Debug().Msg("watcher unknown")
+	}
+}
+
+// refreshSources updates the files in the build, which change when imports do
+func (mgr *flogoStateManager) refreshSources(logger zerolog.Logger) {
+	if mgr.sources == nil {
+		return
+	}
+	err := mgr.sources.Refresh()
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to refresh the files in the build")
+	}
+}
+func (mgr *flogoStateManager) sendAnalyzer() {
+	if mgr.state.Analyzer == nil {
+		return
+	}
+	go func() {
+		mgr.chanDoAnalyzer <- struct{}{}
+	}()
+}
+func (mgr *flogoStateManager) sendTester(path string) {
+	if mgr.state.Tester == nil {
+		return
+	}
+	go func() {
+		mgr.chanDoTester <- path
+	}()
+}
 func (mgr *flogoStateManager) sendRunnerRestart() {
 	mgr.chanDoRunner <- struct{}{}
 }
+func (mgr *flogoStateManager) sendWebpage(msg MessageSSE) {
+	mgr.chanDoWebpage <- msg
+}
 func (mgr *flogoStateManager) sendUpdates(s *state.Flogo) {
 	mgr.chanDoUI <- mgr.state
 	mgr.chanDoWebserver <- mgr.state
@@ -1,21 +1,42 @@
 package state
 
+import (
+	"github.com/Gleipnir-Technology/flogo/process"
+)
+
 type Flogo struct {
-	Builder *Builder
-	Runner  *Runner
+	// Nil when flogo isn't running analyzers
+	Analyzer *Analyzer
+	Builder  *Builder
+	Runner   *Runner
+	// Nil when flogo isn't running tests
+	Tester *Tester
 }
 type Process struct {
+	// The arguments the process was started with
+	Args []string
+	// The extra environment variables the process was started with, in "KEY=value" form
+	Env      []string
 	ExitCode *int
-	Output   []byte
-	Stderr   []byte
-	Stdout   []byte
+	// The latest lines of stdout and stderr. They are shared with whatever is
+	// producing them, so they may keep growing while the process runs.
+	Output *process.Lines
+	// The program that was run
+	Path string
+	// The signal that ended the process, like "SIGTERM". Empty if it is still
+	// running or exited by itself.
+	StopSignal string
 }
 type StatusBuilder int
 
 const (
-	StatusBuilderCompiling StatusBuilder = iota
+	// The last build was abandoned for a newer one
+	StatusBuilderCancelled StatusBuilder = iota
+	StatusBuilderCompiling
 	StatusBuilderFailed
 	StatusBuilderOK
+	// The output was already built from the current sources, so we didn't build
+	StatusBuilderUpToDate
 )
 
 type Builder struct {
@@ -27,6 +48,8 @@ type Runner struct {
 	RunPrevious *Process
 	RunCurrent  *Process
 	Status      StatusRunner
+	// Where the proxy is sending requests, once a process is ready
+	Upstream string
 }
 type StatusRunner int
 
@@ -39,16 +62,25 @@ const (
 
 func StatusStringBuilder(s StatusBuilder) string {
 	switch s {
+	case StatusBuilderCancelled:
+		return "cancelled"
 	case StatusBuilderCompiling:
 		return "compiling"
 	case StatusBuilderFailed:
 		return "failed"
 	case StatusBuilderOK:
 		return "ok"
+	case StatusBuilderUpToDate:
+		return "up to date"
 	}
 	return "unknown"
 }
 
+// IsBuilt is true when the builder isn't showing anything more interesting than the runner
+func (b *Builder) IsBuilt() bool {
+	return b.Status == StatusBuilderOK || b.Status == StatusBuilderUpToDate
+}
+
 func StatusStringRunner(s StatusRunner) string {
 	switch s {
 	case StatusRunnerRunning:
@@ -62,3 +94,120 @@ func StatusStringRunner(s StatusRunner) string {
 	}
 	return "unknown"
 }
+
+type StatusTester int
+
+const (
+	StatusTesterFailed StatusTester = iota
+	// No tests have run yet
+	StatusTesterIdle
+	StatusTesterOK
+	StatusTesterRunning
+)
+
+type Tester struct {
+	// The packages the current run is testing
+	Packages    []string
+	Results     []*TestResult
+	Status      StatusTester
+	TestCurrent *Process
+}
+
+// TestResult is the outcome of a single test. A result without a Test is for
+// a whole package that failed outside of any test, like a build error.
+type TestResult struct {
+	// How long the test took, in seconds
+	Elapsed float64
+	// What the test printed
+	Output  []byte
+	Package string
+	// "pass", "fail" or "skip", or "" while the test is running
+	Result string
+	Test   string
+}
+
+// Counts gets how many tests passed, failed and were skipped
+func (t *Tester) Counts() (passed int, failed int, skipped int) {
+	for _, r := range t.Results {
+		switch r.Result {
+		case "pass":
+			passed++
+		case "fail":
+			failed++
+		case "skip":
+			skipped++
+		}
+	}
+	return passed, failed, skipped
+}
+
+// Failures gets the results of the tests that failed
+func (t *Tester) Failures() []*TestResult {
+	result := make([]*TestResult, 0)
+	for _, r := range t.Results {
+		if r.Result == "fail" {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+func StatusStringTester(s StatusTester) string {
+	switch s {
+	case StatusTesterFailed:
+		return "failed"
+	case StatusTesterIdle:
+		return "idle"
+	case StatusTesterOK:
+		return "ok"
+	case StatusTesterRunning:
+		return "running"
+	}
+	return "unknown"
+}
+
+type StatusAnalyzer int
+
+const (
+	// An analyzer couldn't run, or failed without saying why
+	StatusAnalyzerFailed StatusAnalyzer = iota
+	// Nothing has been analyzed yet
+	StatusAnalyzerIdle
+	StatusAnalyzerOK
+	StatusAnalyzerRunning
+	// The analyzers found problems
+	StatusAnalyzerWarnings
+)
+
+type Analyzer struct {
+	AnalyzeCurrent *Process
+	Diagnostics    []*Diagnostic
+	Status         StatusAnalyzer
+}
+
+// Diagnostic is a problem an analyzer found, like 'go vet' does
+type Diagnostic struct {
+	// Zero if the analyzer didn't say
+	Column  int
+	File    string
+	Line    int
+	Message string
+	// The analyzer that found the problem, like "go vet"
+	Source string
+}
+
+func StatusStringAnalyzer(s StatusAnalyzer) string {
+	switch s {
+	case StatusAnalyzerFailed:
+		return "failed"
+	case StatusAnalyzerIdle:
+		return "idle"
+	case StatusAnalyzerOK:
+		return "ok"
+	case StatusAnalyzerRunning:
+		return "running"
+	case StatusAnalyzerWarnings:
+		return "warnings"
+	}
+	return "unknown"
+}
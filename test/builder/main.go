@@ -7,6 +7,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/Gleipnir-Technology/flogo/process"
 	"github.com/Gleipnir-Technology/flogo/state"
 	"github.com/Gleipnir-Technology/flogo/ui"
 )
@@ -41,7 +42,7 @@ func main() {
 		},
 		Runner: &state.Runner{
 			RunCurrent: &state.Process{
-				Output: []byte{},
+				Output: process.NewLines(process.DefaultCapacity),
 			},
 			Status: state.StatusRunnerRunning,
 		},
@@ -51,7 +52,7 @@ func main() {
 		select {
 		case <-ticker.C:
 			counter++
-			state.Runner.RunCurrent.Output = fmt.Appendf(state.Runner.RunCurrent.Output, "%d", counter)
+			state.Runner.RunCurrent.Output.Append(process.StreamStdout, fmt.Appendf(nil, "%d", counter))
 			do_ui <- state
 		case evt := <-on_ui:
 			switch evt.Type {
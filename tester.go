@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Gleipnir-Technology/flogo/process"
+	"github.com/Gleipnir-Technology/flogo/state"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+type EventTesterType int
+
+const (
+	EventTestFailure EventTesterType = iota
+	EventTestOutput
+	EventTestStart
+	EventTestSuccess
+)
+
+type EventTester struct {
+	// The packages being tested
+	Packages []string
+	Process  *state.Process
+	Results  []*state.TestResult
+	Type     EventTesterType
+}
+
+// Tester runs 'go test' on the packages affected by each change. It runs
+// alongside the builder and doesn't hold up the runner.
+type Tester struct {
+	// Extra arguments to 'go test', like "-race" or "-short"
+	Args     []string
+	Debounce time.Duration
+	OnEvent  chan<- EventTester
+	// The signals that stop the tests, in order, and how long to wait after each
+	StopSignals []syscall.Signal
+	StopTimeout time.Duration
+	Tags        []string
+	Target      string
+	// The files that changed
+	ToTest <-chan string
+
+	mu sync.Mutex
+	// The files that changed since the last run started
+	changed map[string]bool
+}
+
+// How often to send results while tests are running
+const testerOutputInterval = time.Millisecond * 250
+
+func (t *Tester) Run(ctx context.Context) error {
+	logger := log.Ctx(ctx).With().Caller().Logger()
+	debounce := newDebounce(ctx, t.Debounce)
+	t.changed = make(map[string]bool)
+	chan_run := make(chan struct{})
+
+	// Each run gets its own process so events from a run we stopped can't be
+	// confused with the one that replaced it
+	var current *process.Process
+	var sub *process.Subscription[process.EventProcess]
+	var sub_c <-chan process.EventProcess
+	var packages []string
+	// The results so far, read from the output as it comes rather than all at the end
+	var results *testParser
+	// Which packages import which, until a change alters that
+	var graph *importGraph
+	last_output := time.Time{}
+	logger.Info().Msg("Started tester loop")
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info().Msg("Shutdown tester")
+			if current != nil {
+				current.Stop()
+			}
+			return nil
+		case evt, ok := <-sub_c:
+			if !ok {
+				sub_c = nil
+				continue
+			}
+			results.Read(current.Output())
+			switch evt.Type {
+			case process.EventProcessStop:
+				t.onExit(logger, current, packages, results, evt.ProcessState)
+				sub.Close()
+				sub_c = nil
+			case process.EventProcessStart:
+			case process.EventProcessOutput:
+				if time.Since(last_output) > testerOutputInterval {
+					last_output = time.Now()
+					t.onOutput(logger, current, packages, results)
+				}
+			default:
+				logger.Warn().Msg("unrecognized process event")
+			}
+		case path := <-t.ToTest:
+			t.mu.Lock()
+			t.changed[path] = true
+			t.mu.Unlock()
+			debounce(func() {
+				select {
+				case chan_run <- struct{}{}:
+				case <-ctx.Done():
+				}
+			})
+		case <-chan_run:
+			t.mu.Lock()
+			changed := t.changed
+			t.changed = make(map[string]bool)
+			t.mu.Unlock()
+			if graph == nil || graph.Stale(changed) {
+				g, err := loadImportGraph(t.Target, t.Tags)
+				if err != nil {
+					logger.Warn().Err(err).Msg("failed to find the packages to test")
+					continue
+				}
+				logger.Debug().Int("packages", len(g.byDir)).Msg("listed the packages to test")
+				graph = g
+			}
+			affected := affectedPackages(graph, changed)
+			if len(affected) == 0 {
+				logger.Debug().Msg("no packages to test")
+				continue
+			}
+			if current != nil {
+				sub.Close()
+				current.Stop()
+			}
+			packages = affected
+			results = newTestParser()
+			current = t.newProcess(packages)
+			sub = current.OnEvent.Subscribe()
+			sub_c = sub.C
+			err := current.Start(ctx)
+			if err != nil {
+				logger.Error().Err(err).Msg("failed to start tests")
+				sub.Close()
+				sub_c = nil
+				t.onStartErr(logger, current, packages, results, err)
+				continue
+			}
+			t.onStart(logger, current, packages, results)
+		}
+	}
+}
+
+func (t *Tester) newProcess(packages []string) *process.Process {
+	args := []string{"test", "-json"}
+	if len(t.Tags) > 0 {
+		args = append(args, "-tags", strings.Join(t.Tags, ","))
+	}
+	args = append(args, t.Args...)
+	args = append(args, packages...)
+	p := process.New("go", args...)
+	p.SetDir(t.Target)
+	// Stopping 'go test' stops the test binaries it started too
+	p.SetGroup(true)
+	p.SetStop(t.StopSignals, t.StopTimeout)
+	return p
+}
+
+func (t *Tester) onExit(logger zerolog.Logger, p *process.Process, packages []string, parser *testParser, s *os.ProcessState) {
+	results := parser.Results()
+	i := s.ExitCode()
+	typ := EventTestSuccess
+	// 'go test' exits with an error when anything failed, including builds
+	if i != 0 {
+		typ = EventTestFailure
+	}
+	for _, r := range results {
+		if r.Result == "fail" {
+			typ = EventTestFailure
+		}
+	}
+	logger.Debug().Int("results", len(results)).Msg("tests done")
+	ps := newTesterProcess(p, parser)
+	ps.ExitCode = &i
+	t.OnEvent <- EventTester{
+		Packages: packages,
+		Process:  ps,
+		Results:  results,
+		Type:     typ,
+	}
+}
+func (t *Tester) onOutput(logger zerolog.Logger, p *process.Process, packages []string, parser *testParser) {
+	t.OnEvent <- EventTester{
+		Packages: packages,
+		Process:  newTesterProcess(p, parser),
+		Results:  parser.Results(),
+		Type:     EventTestOutput,
+	}
+}
+func (t *Tester) onStart(logger zerolog.Logger, p *process.Process, packages []string, parser *testParser) {
+	logger.Debug().Strs("packages", packages).Msg("testing")
+	t.OnEvent <- EventTester{
+		Packages: packages,
+		Process:  newTesterProcess(p, parser),
+		Results:  []*state.TestResult{},
+		Type:     EventTestStart,
+	}
+}
+
+// onStartErr reports tests that couldn't be started. Each package fails, like
+// one that doesn't build, with why in its output.
+func (t *Tester) onStartErr(logger zerolog.Logger, p *process.Process, packages []string, parser *testParser, err error) {
+	msg := "flogo: failed to start tests: " + err.Error()
+	parser.stderr.Append(process.StreamStderr, []byte(msg))
+	results := make([]*state.TestResult, 0, len(packages))
+	for _, pkg := range packages {
+		results = append(results, &state.TestResult{
+			Output:  []byte(msg + "\n"),
+			Package: pkg,
+			Result:  "fail",
+		})
+	}
+	t.OnEvent <- EventTester{
+		Packages: packages,
+		Process:  newTesterProcess(p, parser),
+		Results:  results,
+		Type:     EventTestFailure,
+	}
+}
+
+// newTesterProcess gets the state of the test process. The JSON on stdout is
+// turned into results, so only stderr is worth showing.
+func newTesterProcess(p *process.Process, parser *testParser) *state.Process {
+	return &state.Process{
+		Args:     p.Args(),
+		ExitCode: nil,
+		Output:   parser.stderr,
+		Path:     p.Path(),
+	}
+}
+
+// testEvent is a line of 'go test -json' output, see 'go doc test2json'
+type testEvent struct {
+	Action  string
+	Elapsed float64
+	// Set instead of Package for build output
+	ImportPath string
+	Output     string
+	Package    string
+	Test       string
+}
+
+// testParser turns 'go test -json' output into a result for each test, plus
+// one for each package that failed without a failing test. The output is read
+// as it comes, so it doesn't matter that only the latest lines are kept.
+type testParser struct {
+	// The packages with a failing test
+	failed map[string]bool
+	// The sequence number of the next line to read
+	next     int
+	packages map[string]*state.TestResult
+	// What 'go test' itself printed, rather than the tests
+	stderr *process.Lines
+	tests  map[string]*state.TestResult
+	// The tests in the order they started
+	order []*state.TestResult
+}
+
+func newTestParser() *testParser {
+	return &testParser{
+		failed:   make(map[string]bool),
+		packages: make(map[string]*state.TestResult),
+		stderr:   process.NewLines(process.DefaultCapacity),
+		tests:    make(map[string]*state.TestResult),
+		order:    make([]*state.TestResult, 0),
+	}
+}
+
+// Read parses the lines of output added since last time
+func (tp *testParser) Read(output *process.Lines) {
+	lines, next := output.Since(tp.next)
+	tp.next = next
+	for _, line := range lines {
+		if line.Stream == process.StreamStderr {
+			tp.stderr.AppendLine(line)
+			continue
+		}
+		tp.parseLine(line.Data)
+	}
+}
+func (tp *testParser) parseLine(line []byte) {
+	if len(line) == 0 || line[0] != '{' {
+		return
+	}
+	var e testEvent
+	if err := json.Unmarshal(line, &e); err != nil {
+		return
+	}
+	if e.Action == "build-output" {
+		// The import path of a test build looks like "pkg [pkg.test]"
+		pkg, _, _ := strings.Cut(e.ImportPath, " ")
+		e.Package = pkg
+		e.Action = "output"
+	}
+	var r *state.TestResult
+	if e.Test == "" {
+		r = tp.packages[e.Package]
+		if r == nil {
+			r = &state.TestResult{Package: e.Package}
+			tp.packages[e.Package] = r
+		}
+	} else {
+		key := e.Package + " " + e.Test
+		r = tp.tests[key]
+		if r == nil {
+			r = &state.TestResult{Package: e.Package, Test: e.Test}
+			tp.tests[key] = r
+			tp.order = append(tp.order, r)
+		}
+	}
+	switch e.Action {
+	case "output":
+		r.Output = append(r.Output, e.Output...)
+	case "fail", "pass", "skip":
+		r.Result = e.Action
+		r.Elapsed = e.Elapsed
+		if e.Action == "fail" && e.Test != "" {
+			tp.failed[e.Package] = true
+		}
+	}
+}
+
+// Results gets a copy of the results so far, since the parser keeps changing them
+func (tp *testParser) Results() []*state.TestResult {
+	result := make([]*state.TestResult, 0, len(tp.order))
+	for _, r := range tp.order {
+		c := *r
+		result = append(result, &c)
+	}
+	names := make([]string, 0, len(tp.packages))
+	for name := range tp.packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r := tp.packages[name]
+		if r.Result == "fail" && !tp.failed[name] {
+			c := *r
+			result = append(result, &c)
+		}
+	}
+	return result
+}
+
+// importGraph is which local packages import which. Listing them means
+// walking every dependency, so it's kept until a change could alter it.
+type importGraph struct {
+	byDir  map[string]*goPackage
+	byFile map[string]*goPackage
+	// The import paths of the packages that import each package, directly or
+	// through their tests
+	importers map[string][]string
+}
+
+// loadImportGraph lists the packages under target, their tests and everything
+// they depend on
+func loadImportGraph(target string, tags []string) (*importGraph, error) {
+	args := []string{"-deps", "-test"}
+	if len(tags) > 0 {
+		args = append(args, "-tags", strings.Join(tags, ","))
+	}
+	packages, err := goList(target, append(args, "./...")...)
+	if err != nil {
+		return nil, err
+	}
+	g := &importGraph{
+		byDir:     make(map[string]*goPackage),
+		byFile:    make(map[string]*goPackage),
+		importers: make(map[string][]string),
+	}
+	for i := range packages {
+		p := &packages[i]
+		if !p.IsLocal() || p.Dir == "" {
+			continue
+		}
+		// The test variants of a package repeat it with the imports of its
+		// tests, which it already lists
+		if p.ForTest != "" || strings.HasSuffix(p.ImportPath, ".test") {
+			continue
+		}
+		g.byDir[p.Dir] = p
+		for _, f := range p.EmbedFiles {
+			g.byFile[filepath.Join(p.Dir, f)] = p
+		}
+		for _, imports := range [][]string{p.Imports, p.TestImports, p.XTestImports} {
+			for _, imp := range imports {
+				g.importers[imp] = append(g.importers[imp], p.ImportPath)
+			}
+		}
+	}
+	return g, nil
+}
+
+// Stale decides whether any of the changed files could change the graph: a
+// module file, a Go file in a directory that wasn't a package, or one that
+// imports something its package didn't
+func (g *importGraph) Stale(changed map[string]bool) bool {
+	for f := range changed {
+		if isModuleFile(f) {
+			return true
+		}
+		if _, ok := g.byDir[f]; ok {
+			// A package directory was removed or renamed
+			return true
+		}
+		if filepath.Ext(f) != ".go" {
+			continue
+		}
+		p, ok := g.byDir[filepath.Dir(f)]
+		if !ok {
+			return true
+		}
+		parsed, err := parser.ParseFile(token.NewFileSet(), f, nil, parser.ImportsOnly)
+		if err != nil {
+			// Removed, or not finished being written. Either way it's only
+			// ever going to have fewer imports.
+			continue
+		}
+		for _, spec := range parsed.Imports {
+			imp, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				continue
+			}
+			if !slices.Contains(p.Imports, imp) && !slices.Contains(p.TestImports, imp) && !slices.Contains(p.XTestImports, imp) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isModuleFile is true for the files that say which modules are used
+func isModuleFile(path string) bool {
+	switch filepath.Base(path) {
+	case "go.mod", "go.sum", "go.work", "go.work.sum":
+		return true
+	}
+	return false
+}
+
+// affectedPackages finds the packages in the main modules whose tests could
+// change because of the changed files: the packages the files are in, and
+// every package that imports those, directly or through its tests.
+func affectedPackages(g *importGraph, changed map[string]bool) []string {
+	queue := make([]string, 0)
+	everything := false
+	for f := range changed {
+		if isModuleFile(f) {
+			// Any package could be affected
+			everything = true
+		}
+		if p, ok := g.byFile[f]; ok {
+			queue = append(queue, p.ImportPath)
+		} else if p, ok := g.byDir[filepath.Dir(f)]; ok {
+			queue = append(queue, p.ImportPath)
+		}
+	}
+	affected := make(map[string]bool)
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		if affected[path] {
+			continue
+		}
+		affected[path] = true
+		queue = append(queue, g.importers[path]...)
+	}
+
+	result := make([]string, 0)
+	for _, p := range g.byDir {
+		if p.Module == nil || !p.Module.Main {
+			continue
+		}
+		if everything || affected[p.ImportPath] {
+			result = append(result, p.ImportPath)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -3,14 +3,22 @@ package ui
 import (
 	"context"
 	"fmt"
-	"strings"
+	"time"
 
+	"github.com/Gleipnir-Technology/flogo/process"
 	"github.com/Gleipnir-Technology/flogo/state"
 	"github.com/rs/zerolog/log"
 )
 
 type uiFlat struct {
 	onEvents chan Event
+	// The output being printed, and the sequence number of the next line to print
+	next   int
+	output *process.Lines
+	// When each stream's partial line that was printed arrived
+	partial map[process.Stream]time.Time
+	// The last status printed
+	status string
 }
 
 func newUIFlat() (*uiFlat, error) {
@@ -34,29 +42,58 @@ func (u *uiFlat) Run(ctx context.Context, chanOnEvent chan<- Event, chanNewState
 		}
 	}
 }
+
+// dump prints the status when it changes, and the lines of output that are new
+// since last time
 func (u *uiFlat) dump(s *state.Flogo) {
-	output := "waiting..."
-	if s.Builder.Status != state.StatusBuilderOK {
-		if s.Builder.BuildCurrent != nil && len(s.Builder.BuildCurrent.Output) > 0 {
-			output = string(s.Builder.BuildCurrent.Output)
-		} else if s.Builder.BuildPrevious != nil && len(s.Builder.BuildPrevious.Output) > 0 {
-			output = string(s.Builder.BuildPrevious.Output)
-		} else {
-			output = "no build output"
-		}
-	} else {
-		if s.Runner.RunCurrent != nil && len(s.Runner.RunCurrent.Output) > 0 {
-			output = string(s.Runner.RunCurrent.Output)
-		} else if s.Runner.RunPrevious != nil && len(s.Runner.RunPrevious.Output) > 0 {
-			output = string(s.Runner.RunPrevious.Output)
-		} else {
-			output = "no run output"
-		}
+	tests := ""
+	if s.Tester != nil {
+		tests = fmt.Sprintf("\ttester %s", state.StatusStringTester(s.Tester.Status))
 	}
-	output = strings.TrimSpace(output)
-	fmt.Printf("builder %s\trunner %s\t%s\n",
+	analyzer := ""
+	if s.Analyzer != nil {
+		analyzer = fmt.Sprintf("\tanalyzer %s", state.StatusStringAnalyzer(s.Analyzer.Status))
+	}
+	status := fmt.Sprintf("builder %s\trunner %s%s%s",
 		state.StatusStringBuilder(s.Builder.Status),
 		state.StatusStringRunner(s.Runner.Status),
-		output,
+		tests,
+		analyzer,
 	)
+	if status != u.status {
+		fmt.Println(status)
+		u.status = status
+	}
+
+	var current *state.Process
+	if !s.Builder.IsBuilt() {
+		current = s.Builder.BuildCurrent
+	} else {
+		current = s.Runner.RunCurrent
+	}
+	if current == nil {
+		return
+	}
+	if current.Output != u.output {
+		u.output = current.Output
+		u.next = 0
+		u.partial = make(map[process.Stream]time.Time)
+	}
+	lines, next := u.output.Since(u.next)
+	u.next = next
+	started := u.output.Started()
+	for _, line := range lines {
+		fmt.Printf("%s %9.3fs %s\n", line.Stream, line.Time.Sub(started).Seconds(), line.Text())
+		delete(u.partial, line.Stream)
+	}
+	// A partial line is only set once it has gone unchanged for a moment, like
+	// a prompt. We can't take back what we print, so it's printed whole again
+	// when the rest of it arrives.
+	for _, line := range u.output.Partial() {
+		if u.partial[line.Stream].Equal(line.Time) {
+			continue
+		}
+		fmt.Printf("%s %9.3fs %s\n", line.Stream, line.Time.Sub(started).Seconds(), line.Text())
+		u.partial[line.Stream] = line.Time
+	}
 }
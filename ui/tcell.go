@@ -4,9 +4,12 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"path/filepath"
 	"reflect"
-	//"time"
+	"strings"
+	"time"
 
+	"github.com/Gleipnir-Technology/flogo/process"
 	"github.com/Gleipnir-Technology/flogo/state"
 	"github.com/gdamore/tcell/v3"
 	"github.com/gdamore/tcell/v3/color"
@@ -18,8 +21,10 @@ type uiTcell struct {
 	currentState *state.Flogo
 	onEvent      chan Event
 	screen       tcell.Screen
-	target       string
-	upstream     url.URL
+	// Whether to show how far into the run each line of output arrived
+	showTimes bool
+	target    string
+	upstream  url.URL
 }
 
 func newUITcell(target string, upstream url.URL) (*uiTcell, error) {
@@ -65,7 +70,10 @@ func (u *uiTcell) Run(ctx context.Context, chanOnEvent chan<- Event, chanNewStat
 			if e.Type != EventNone {
 				chanOnEvent <- e
 			}
-			if e.Type == EventResize {
+			if e.Type == EventTimes {
+				u.showTimes = !u.showTimes
+			}
+			if e.Type == EventResize || e.Type == EventTimes {
 				u.redraw()
 			}
 		case s := <-chanNewState:
@@ -75,6 +83,36 @@ func (u *uiTcell) Run(ctx context.Context, chanOnEvent chan<- Event, chanNewStat
 		}
 	}
 }
+
+// drawLines draws lines of program output. Stderr is colored so it stands out,
+// unless the program colored it itself.
+func (u *uiTcell) drawLines(start_x, start_y int, lines []process.Line, started time.Time) {
+	time_style := tcell.StyleDefault.Foreground(color.Gray)
+	styled := make([]*styledText, 0)
+	for i, line := range lines {
+		if i > 0 {
+			styled = append(styled, &styledText{style: tcell.StyleDefault, text: "\n"})
+		}
+		if u.showTimes {
+			styled = append(styled, &styledText{
+				style: time_style,
+				text:  fmt.Sprintf("%9.3fs ", line.Time.Sub(started).Seconds()),
+			})
+		}
+		converted, err := ansiToTcell(line.Styled)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to convert ANSI")
+			return
+		}
+		for j, c := range converted {
+			if line.Stream == process.StreamStderr && line.Styled[j].FgCol == nil {
+				c.style = c.style.Foreground(color.IndianRed)
+			}
+			styled = append(styled, c)
+		}
+	}
+	u.drawStyledMultilineBottom(start_x, start_y, styled)
+}
 func (u *uiTcell) drawBytesMultiline(start_x, start_y int, buffer []byte) {
 	// If the bytes were ansi, convert them first
 	parsed, err := ansi.Parse(string(buffer))
@@ -141,10 +179,14 @@ func (u *uiTcell) redraw() {
 
 	// Draw title
 	u.drawTitle(u.currentState)
-	if u.currentState.Builder.Status != state.StatusBuilderOK {
+	if !u.currentState.Builder.IsBuilt() {
 		u.drawBuildStatus(u.currentState.Builder)
 	} else {
-		u.drawRunning(u.currentState.Runner)
+		y := 1
+		if u.currentState.Analyzer != nil {
+			y = u.drawDiagnostics(y, u.currentState.Analyzer.Diagnostics)
+		}
+		u.drawRunning(y, u.currentState.Runner)
 	}
 
 	u.screen.Show()
@@ -157,12 +199,15 @@ func (u *uiTcell) drawBuildStatus(s *state.Builder) {
 	style := tcell.StyleDefault.Foreground(color.White)
 	var content string
 	switch s.Status {
+	case state.StatusBuilderCancelled:
+		style = tcell.StyleDefault.Foreground(color.Gray)
+		content = "flogo: build cancelled, files changed"
 	case state.StatusBuilderFailed:
 		style = tcell.StyleDefault.Foreground(color.Red)
 		if s.BuildCurrent != nil {
-			content = string(s.BuildCurrent.Output)
+			content = string(s.BuildCurrent.Output.Bytes())
 		} else if s.BuildPrevious != nil {
-			content = string(s.BuildPrevious.Output)
+			content = string(s.BuildPrevious.Output.Bytes())
 		} else {
 			content = "flogo: no build output to show."
 		}
@@ -170,8 +215,8 @@ func (u *uiTcell) drawBuildStatus(s *state.Builder) {
 		style = tcell.StyleDefault.Foreground(color.Yellow)
 		if s.BuildCurrent == nil {
 			content = "flogo: no output yet"
-		} else if len(s.BuildCurrent.Output) > 0 {
-			content = string(s.BuildCurrent.Output)
+		} else if s.BuildCurrent.Output.Len() > 0 {
+			content = string(s.BuildCurrent.Output.Bytes())
 		} else {
 			content = "flogo: compiling..."
 		}
@@ -218,7 +263,31 @@ func (u *uiTcell) drawBuildOutput(start_x, start_y int, content string, style tc
 func (u *uiTcell) drawCompilation(state *state.Flogo) {
 	u.drawText(0, 1, tcell.StyleDefault.Foreground(color.Yellow), "Compiling...")
 }
-func (u *uiTcell) drawRunning(s *state.Runner) {
+
+// drawDiagnostics lists what the analyzers found, using at most a third of
+// the screen, and gets the line after the list
+func (u *uiTcell) drawDiagnostics(start_y int, diagnostics []*state.Diagnostic) int {
+	if len(diagnostics) == 0 {
+		return start_y
+	}
+	_, max_y := u.screen.Size()
+	limit := max(max_y/3, 1)
+	filename_style := tcell.StyleDefault.Foreground(color.Blue)
+	warning_style := tcell.StyleDefault.Foreground(color.Yellow)
+	y := start_y
+	for i, d := range diagnostics {
+		if i == limit-1 && len(diagnostics) > limit {
+			u.drawText(0, y, warning_style, fmt.Sprintf("... and %d more", len(diagnostics)-i))
+			return y + 1
+		}
+		location := fmt.Sprintf("%s:%d:%d ", d.File, d.Line, d.Column)
+		u.drawText(0, y, filename_style, location)
+		u.drawText(len(location), y, warning_style, fmt.Sprintf("%s (%s)", d.Message, d.Source))
+		y++
+	}
+	return y
+}
+func (u *uiTcell) drawRunning(start_y int, s *state.Runner) {
 	if s == nil {
 		return
 	}
@@ -226,18 +295,20 @@ func (u *uiTcell) drawRunning(s *state.Runner) {
 	switch s.Status {
 	case state.StatusRunnerRunning, state.StatusRunnerStopErr, state.StatusRunnerStopOK:
 		if s.RunCurrent == nil {
-			u.drawText(0, 1, tcell.StyleDefault, "flogo: no runCurrent.")
-		} else if len(s.RunCurrent.Output) > 0 {
-			u.drawBytesMultiline(0, 1, s.RunCurrent.Output)
+			u.drawText(0, start_y, tcell.StyleDefault, "flogo: no runCurrent.")
+		} else if s.RunCurrent.Output.Len() > 0 {
+			// Each line takes at least a row, so there's no point in drawing more than fit
+			_, max_y := u.screen.Size()
+			u.drawLines(0, start_y, s.RunCurrent.Output.Tail(max_y-start_y), s.RunCurrent.Output.Started())
 		} else if s.RunPrevious == nil {
-			u.drawText(0, 1, tcell.StyleDefault, "flogo: no runPrevious.")
+			u.drawText(0, start_y, tcell.StyleDefault, "flogo: no runPrevious.")
 		} else {
-			u.drawText(0, 1, tcell.StyleDefault, "flogo: maybe use previous output...?")
+			u.drawText(0, start_y, tcell.StyleDefault, "flogo: maybe use previous output...?")
 		}
 	case state.StatusRunnerWaiting:
-		u.drawText(0, 1, tcell.StyleDefault, "flogo: waiting...")
+		u.drawText(0, start_y, tcell.StyleDefault, "flogo: waiting...")
 	default:
-		u.drawText(0, 1, tcell.StyleDefault.Foreground(color.Purple), "flogo: programmer error (run)")
+		u.drawText(0, start_y, tcell.StyleDefault.Foreground(color.Purple), "flogo: programmer error (run)")
 	}
 }
 func (u *uiTcell) drawStatus(status string, style tcell.Style) {
@@ -250,12 +321,16 @@ func (u *uiTcell) drawText(x, y int, style tcell.Style, text string) {
 }
 func (u *uiTcell) drawTitle(s *state.Flogo) {
 	switch s.Builder.Status {
+	case state.StatusBuilderCancelled:
+		u.drawText(0, 0, tcell.StyleDefault.Foreground(color.Gray).Bold(true), "Cancelled")
 	case state.StatusBuilderCompiling:
 		u.drawText(0, 0, tcell.StyleDefault.Foreground(color.Yellow).Bold(true), "Compiling")
 	case state.StatusBuilderFailed:
 		u.drawText(0, 0, tcell.StyleDefault.Foreground(color.Red).Bold(true), "Failed")
 	case state.StatusBuilderOK:
 		u.drawText(0, 0, tcell.StyleDefault.Foreground(color.Green).Bold(true), "Idle")
+	case state.StatusBuilderUpToDate:
+		u.drawText(0, 0, tcell.StyleDefault.Foreground(color.Green).Bold(true), "Current")
 	default:
 		u.drawText(0, 0, tcell.StyleDefault.Foreground(color.Purple).Bold(true), "Unknown")
 	}
@@ -272,7 +347,102 @@ func (u *uiTcell) drawTitle(s *state.Flogo) {
 	default:
 		u.drawText(10, 0, tcell.StyleDefault.Foreground(color.Purple).Bold(true), "Unknown")
 	}
-	u.drawText(20, 0, tcell.StyleDefault.Foreground(color.Green).Bold(true), u.upstream.String())
+	upstream := u.upstream.String()
+	if s.Runner.Upstream != "" {
+		upstream = s.Runner.Upstream
+	}
+	u.drawText(20, 0, tcell.StyleDefault.Foreground(color.Green).Bold(true), upstream)
+	if s.Runner.RunCurrent != nil {
+		u.drawText(21+len(upstream), 0, tcell.StyleDefault.Foreground(color.Gray), describeLaunch(s.Runner.RunCurrent))
+	}
+	right, _ := u.screen.Size()
+	if s.Tester != nil {
+		right = u.drawTests(right, s.Tester)
+	}
+	if s.Analyzer != nil {
+		u.drawAnalyzer(right, s.Analyzer)
+	}
+}
+
+// drawAnalyzer shows how many problems the analyzers found on the title, ending at right
+func (u *uiTcell) drawAnalyzer(right int, a *state.Analyzer) {
+	var style tcell.Style
+	var text string
+	switch a.Status {
+	case state.StatusAnalyzerFailed:
+		style = tcell.StyleDefault.Foreground(color.Red).Bold(true)
+		text = "Vet failed"
+	case state.StatusAnalyzerIdle:
+		return
+	case state.StatusAnalyzerOK:
+		style = tcell.StyleDefault.Foreground(color.Green).Bold(true)
+		text = "Vet OK"
+	case state.StatusAnalyzerRunning:
+		style = tcell.StyleDefault.Foreground(color.Yellow).Bold(true)
+		text = "Vet running"
+	case state.StatusAnalyzerWarnings:
+		style = tcell.StyleDefault.Foreground(color.Yellow).Bold(true)
+		text = fmt.Sprintf("Vet %d warnings", len(a.Diagnostics))
+	default:
+		style = tcell.StyleDefault.Foreground(color.Purple).Bold(true)
+		text = "Vet unknown"
+	}
+	u.drawText(max(right-len(text), 0), 0, style, text)
+}
+
+// drawTests shows how the tests are doing on the title, ending at right, and
+// gets where the space left of it ends
+func (u *uiTcell) drawTests(right int, t *state.Tester) int {
+	var style tcell.Style
+	switch t.Status {
+	case state.StatusTesterFailed:
+		style = tcell.StyleDefault.Foreground(color.Red).Bold(true)
+	case state.StatusTesterIdle:
+		return right
+	case state.StatusTesterOK:
+		style = tcell.StyleDefault.Foreground(color.Green).Bold(true)
+	case state.StatusTesterRunning:
+		style = tcell.StyleDefault.Foreground(color.Yellow).Bold(true)
+	default:
+		style = tcell.StyleDefault.Foreground(color.Purple).Bold(true)
+	}
+	text := describeTests(t)
+	x := max(right-len(text), 0)
+	u.drawText(x, 0, style, text)
+	return max(x-1, 0)
+}
+
+// describeTests summarizes the test results, like "Tests 12 passed 1 failed"
+func describeTests(t *state.Tester) string {
+	passed, failed, skipped := t.Counts()
+	parts := []string{"Tests"}
+	if t.Status == state.StatusTesterRunning {
+		parts = append(parts, "running")
+	}
+	parts = append(parts, fmt.Sprintf("%d passed", passed))
+	if failed > 0 || t.Status == state.StatusTesterFailed {
+		parts = append(parts, fmt.Sprintf("%d failed", failed))
+	}
+	if skipped > 0 {
+		parts = append(parts, fmt.Sprintf("%d skipped", skipped))
+	}
+	return strings.Join(parts, " ")
+}
+
+// describeLaunch summarizes how the runner process was started. Only the names
+// of environment variables are shown since their values may be secret.
+func describeLaunch(p *state.Process) string {
+	parts := []string{filepath.Base(p.Path)}
+	parts = append(parts, p.Args...)
+	if len(p.Env) > 0 {
+		keys := make([]string, len(p.Env))
+		for i, e := range p.Env {
+			k, _, _ := strings.Cut(e, "=")
+			keys[i] = k
+		}
+		parts = append(parts, fmt.Sprintf("[env: %s]", strings.Join(keys, " ")))
+	}
+	return strings.Join(parts, " ")
 }
 func (u *uiTcell) sync() {
 	u.screen.Sync()
@@ -305,6 +475,8 @@ func convertEvent(evt tcell.Event) Event {
 			return Event{Type: EventDebug}
 		} else if ev.Str() == "r" {
 			return Event{Type: EventRestart}
+		} else if ev.Str() == "t" {
+			return Event{Type: EventTimes}
 		} else {
 			logger.Debug().Msg("updating webserver from keypress")
 			return Event{Type: EventUpdate}
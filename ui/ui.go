@@ -15,6 +15,8 @@ const (
 	EventExit
 	EventResize
 	EventRestart
+	// Show or hide when each line of output arrived
+	EventTimes
 	EventUpdate // forcibly update clients
 
 )
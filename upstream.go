@@ -2,13 +2,16 @@ package main
 
 import (
 	//"log"
+	"context"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"time"
 )
+
 var (
-	upstreamURL      *url.URL
+	upstreamURL *url.URL
 )
 
 func proxyHandler(w http.ResponseWriter, r *http.Request) {
@@ -18,10 +21,10 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Upstream server is not available. Your application is either starting up or has errors."))
 		return
 	}
-	
+
 	// Create a reverse proxy
 	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
-	
+
 	// Update the headers to allow for SSL redirection
 	r.URL.Host = upstreamURL.Host
 	r.URL.Scheme = upstreamURL.Scheme
@@ -43,3 +46,67 @@ func isUpstreamAlive() bool {
 	return resp.StatusCode < 500 // Consider any status below 500 as "alive"
 }
 
+// upstreamAddress gets the host:port we should dial to reach the upstream
+func upstreamAddress(upstream url.URL) string {
+	if upstream.Port() != "" {
+		return upstream.Host
+	}
+	if upstream.Scheme == "https" {
+		return net.JoinHostPort(upstream.Hostname(), "443")
+	}
+	return net.JoinHostPort(upstream.Hostname(), "80")
+}
+
+// upstreamPort gets the port the upstream listens on
+func upstreamPort(upstream url.URL) string {
+	_, port, err := net.SplitHostPort(upstreamAddress(upstream))
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// waitForUpstream polls the upstream until it is ready. It returns false if the
+// context ends first. With an empty path the upstream is ready when it accepts
+// connections, otherwise when a GET of path gets a response below 500.
+func waitForUpstream(ctx context.Context, upstream url.URL, path string) bool {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if isUpstreamReady(ctx, upstream, path) {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+func isUpstreamReady(ctx context.Context, upstream url.URL, path string) bool {
+	if path == "" {
+		dialer := net.Dialer{
+			Timeout: 100 * time.Millisecond,
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", upstreamAddress(upstream))
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	client := http.Client{
+		Timeout: time.Second,
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream.JoinPath(path).String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode < 500
+}
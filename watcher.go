@@ -3,85 +3,527 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+type EventWatcherType int
+
+const (
+	// A static file the browser can reload without a rebuild
+	EventWatcherAsset EventWatcherType = iota
+	// A file that requires a rebuild
+	EventWatcherSource
+	// A Go file that isn't in the binary but may change the results of tests
+	EventWatcherTest
+)
+
+type EventWatcher struct {
+	// The absolute path to the file that changed
+	Path string
+	// The path to the file relative to the target, using forward slashes
+	Rel  string
+	Type EventWatcherType
+}
+
+// What to do when a file changes
+type WatchAction int
+
+const (
+	WatchActionIgnore WatchAction = iota
+	// Swap the file in the browser without rebuilding
+	WatchActionAsset
+	WatchActionRebuild
+	// Run the tests without rebuilding
+	WatchActionTest
+)
+
+// ParseWatchAction converts the name of an action from the configuration
+func ParseWatchAction(s string) (WatchAction, error) {
+	switch s {
+	case "asset":
+		return WatchActionAsset, nil
+	case "ignore":
+		return WatchActionIgnore, nil
+	case "rebuild":
+		return WatchActionRebuild, nil
+	}
+	return WatchActionIgnore, fmt.Errorf("'%s' is not one of 'asset', 'ignore' or 'rebuild'", s)
+}
+
+func watchActionString(a WatchAction) string {
+	switch a {
+	case WatchActionAsset:
+		return "asset"
+	case WatchActionIgnore:
+		return "ignore"
+	case WatchActionRebuild:
+		return "rebuild"
+	case WatchActionTest:
+		return "test"
+	}
+	return "unknown"
+}
+
 type Watcher struct {
-	OnEvent chan<- string
+	// Directories of local modules outside the target that the build uses.
+	// Changes to these cause a rebuild.
+	Dependencies []string
+	// Glob patterns for paths that should never be watched
+	Exclude []string
+	// What to do when a file with a given extension changes
+	Extensions map[string]WatchAction
+	// Whether to skip the paths that git ignores
+	Gitignore bool
+	// Glob patterns for files that should trigger a rebuild
+	Include []string
+	// How to find out about changes
+	Mode    WatchMode
+	OnEvent chan<- EventWatcher
+	// How often to check files when polling
+	PollInterval time.Duration
+	// Whether to report changes to Go files that don't cause a rebuild, so
+	// their tests can run
+	RunTests bool
+	// The files that go into the binary. Go files that aren't part of it
+	// don't cause a rebuild. Nil to rebuild for every Go file.
+	Sources *buildSources
 	Target  string
+	// Whether changes to _test.go files cause a rebuild
+	Tests bool
 }
 
 func (w Watcher) Run(ctx context.Context) error {
-	// Create a new watcher
 	logger := log.Ctx(ctx).With().Caller().Logger()
-	watcher, err := fsnotify.NewWatcher()
+	filter, err := w.newFilter()
 	if err != nil {
-		return fmt.Errorf("Failed to create new watcher: %w", err)
+		return err
 	}
 
 	// Recursively add directories to watch
-	abs, err := filepath.Abs(w.Target)
+	watched := make(map[string]bool)
+	watcher, err := w.newNotifier(logger, filter, watched)
 	if err != nil {
-		return fmt.Errorf("Determine abs: %w", err)
+		return err
 	}
-	err = filepath.Walk(abs, func(path string, info os.FileInfo, err error) error {
+	// The watcher is replaced if we fall back to polling
+	defer func() {
+		watcher.Close()
+	}()
+
+	logger.Info().Str("target", w.Target).Strs("dependencies", w.Dependencies).Msg("Started watcher loop")
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events():
+			if !ok {
+				return fmt.Errorf("Failed to get file watcher event")
+			}
+
+			// Check if it was modified, created, removed or renamed
+			if !(event.Has(fsnotify.Write) || event.Has(fsnotify.Create) ||
+				event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)) {
+				continue
+			}
+			typestring := eventToString(event)
+			if filter.gitignore != nil && filepath.Base(event.Name) == ".gitignore" {
+				filter.gitignore.Forget(filepath.Dir(event.Name))
+			}
+			// A new directory, maybe a new package or one moved into place
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					files, err := watchTree(logger, watcher, filter, event.Name, watched)
+					if err != nil && isNotifyLimit(err) && w.Mode == WatchModeAuto {
+						// Same as running out at startup, except some of the
+						// new directory may not have been walked yet
+						logger.Warn().Err(err).Str("name", event.Name).Msg("out of file notifications, falling back to polling")
+						watcher.Close()
+						clear(watched)
+						w.Mode = WatchModePoll
+						watcher, err = w.newNotifier(logger, filter, watched)
+						if err != nil {
+							return err
+						}
+						files, err = watchTree(logger, watcher, filter, event.Name, watched)
+					}
+					if err != nil && isNotifyLimit(err) {
+						logger.Warn().Err(err).Str("name", event.Name).Msg("out of file notifications, set watch.mode = \"poll\" in " + configFilename)
+					} else if err != nil {
+						logger.Warn().Err(err).Str("name", event.Name).Msg("failed to watch new directory")
+					}
+					for _, f := range files {
+						w.notify(logger, filter, f, typestring)
+					}
+					continue
+				}
+			}
+			// A directory going away takes any packages in it with it
+			if (event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)) && watched[event.Name] {
+				unwatchTree(logger, watcher, event.Name, watched)
+				rebuild, reason := true, "the packages in the build are unknown"
+				if w.Sources != nil {
+					rebuild, reason = w.Sources.Removes(event.Name)
+				}
+				logger.Debug().Str("name", event.Name).Str("type", typestring).Str("reason", reason).Bool("rebuild", rebuild).Msg("watched directory removed")
+				// Like removing an asset, removing a directory of them gives
+				// the browser nothing new to load
+				if !rebuild {
+					continue
+				}
+				go func() {
+					w.OnEvent <- EventWatcher{
+						Path: event.Name,
+						Rel:  filter.rel(event.Name),
+						Type: EventWatcherSource,
+					}
+				}()
+				continue
+			}
+			// Removing an asset doesn't give the browser anything new to load
+			if (event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)) && !event.Has(fsnotify.Create) {
+				if action, _ := filter.decideFile(event.Name); action == WatchActionAsset {
+					continue
+				}
+			}
+			w.notify(logger, filter, event.Name, typestring)
+
+		case err, ok := <-watcher.Errors():
+			if !ok {
+				return fmt.Errorf("Failed to get file watcher errors: %w", err)
+			} else {
+				return fmt.Errorf("Got watcher error: %w", err)
+			}
+		}
+	}
+}
+
+// newNotifier creates the notifier for the configured mode and adds the
+// directories under the target to it
+func (w Watcher) newNotifier(logger zerolog.Logger, filter *watchFilter, watched map[string]bool) (notifier, error) {
+	if w.Mode == WatchModePoll {
+		n := newPollNotifier(w.PollInterval)
+		err := watchRoots(logger, n, filter, watched)
 		if err != nil {
-			return fmt.Errorf("creating walk: %w", err)
+			n.Close()
+			return nil, fmt.Errorf("Failed to walk filepath: %w", err)
+		}
+		logger.Info().Dur("interval", w.PollInterval).Msg("polling for changes")
+		return n, nil
+	}
+	n, err := newFSNotifier()
+	if err == nil {
+		err = watchRoots(logger, n, filter, watched)
+		if err == nil {
+			return n, nil
+		}
+		n.Close()
+	}
+	if w.Mode == WatchModeNotify || !isNotifyLimit(err) {
+		return nil, fmt.Errorf("Failed to watch '%s': %w", filter.root, err)
+	}
+	// Typically fs.inotify.max_user_watches or max_user_instances is too low
+	logger.Warn().Err(err).Msg("out of file notifications, falling back to polling")
+	for k := range watched {
+		delete(watched, k)
+	}
+	w.Mode = WatchModePoll
+	return w.newNotifier(logger, filter, watched)
+}
+
+// notify sends an event for a change to the file, if the change matters
+func (w Watcher) notify(logger zerolog.Logger, filter *watchFilter, name string, typestring string) {
+	action, reason := filter.decideFile(name)
+	var t EventWatcherType
+	switch action {
+	case WatchActionAsset:
+		t = EventWatcherAsset
+	case WatchActionRebuild:
+		t = EventWatcherSource
+	case WatchActionTest:
+		t = EventWatcherTest
+	default:
+		return
+	}
+	logger.Debug().Str("name", name).Str("type", typestring).Str("reason", reason).Msg("notify event")
+
+	evt := EventWatcher{
+		Path: name,
+		Rel:  filter.rel(name),
+		Type: t,
+	}
+	go func() {
+		w.OnEvent <- evt
+	}()
+}
+
+// watchRoots adds the target and the local dependencies to the watcher
+func watchRoots(logger zerolog.Logger, watcher notifier, filter *watchFilter, watched map[string]bool) error {
+	for _, root := range filter.roots {
+		_, err := watchTree(logger, watcher, filter, root, watched)
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		// Skip hidden directories and vendor
-		if info.IsDir() && (strings.HasPrefix(info.Name(), ".") || info.Name() == "vendor") {
-			logger.Debug().Str("name", info.Name()).Msg("Skipping")
+// watchTree adds dir and every directory under it that we don't skip to the
+// watcher. It gets the files found along the way.
+func watchTree(logger zerolog.Logger, watcher notifier, filter *watchFilter, dir string, watched map[string]bool) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("creating walk: %w", err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			return nil
+		}
+		// Skip hidden directories, vendor and anything excluded or ignored
+		if skip, reason := filter.skipDir(path); skip {
+			logger.Debug().Str("name", info.Name()).Str("reason", reason).Msg("Skipping")
 			return filepath.SkipDir
 		}
+		if watched[path] {
+			return nil
+		}
 
 		// Add directories to watch
-		if info.IsDir() {
-			logger.Debug().Str("path", path).Msg("add to watch list")
-			return watcher.Add(path)
+		logger.Debug().Str("path", path).Msg("add to watch list")
+		err = watcher.Add(path)
+		if err != nil {
+			return err
 		}
+		watched[path] = true
 		return nil
 	})
+	return files, err
+}
+
+// unwatchTree stops watching dir and everything under it
+func unwatchTree(logger zerolog.Logger, watcher notifier, dir string, watched map[string]bool) {
+	prefix := dir + string(filepath.Separator)
+	for path := range watched {
+		if path != dir && !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		// The watch is usually already gone along with the directory
+		watcher.Remove(path)
+		delete(watched, path)
+		logger.Debug().Str("path", path).Msg("remove from watch list")
+	}
+}
+
+// watchFilter decides which paths the watcher cares about
+type watchFilter struct {
+	gitignore *gitignore
+	// The target
+	root string
+	// The target and the local dependencies
+	roots   []string
+	watcher *Watcher
+}
 
+func (w *Watcher) newFilter() (*watchFilter, error) {
+	abs, err := filepath.Abs(w.Target)
 	if err != nil {
-		return fmt.Errorf("Failed to walk filepath: %w", err)
+		return nil, fmt.Errorf("Determine abs: %w", err)
+	}
+	result := &watchFilter{
+		root:    abs,
+		roots:   append([]string{abs}, w.Dependencies...),
+		watcher: w,
+	}
+	if w.Gitignore {
+		result.gitignore, err = newGitignore(abs)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load gitignore: %w", err)
+		}
 	}
+	return result, nil
+}
 
-	logger.Info().Str("target", w.Target).Msg("Started watcher loop")
-	for {
-		select {
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return fmt.Errorf("Failed to get file watcher event")
-			}
+// rel gets the path relative to the target, with forward slashes
+func (f *watchFilter) rel(name string) string {
+	rel, err := filepath.Rel(f.root, name)
+	if err != nil {
+		return filepath.ToSlash(name)
+	}
+	return filepath.ToSlash(rel)
+}
 
-			// Check if it's a .go file and if it was modified, created, or renamed
-			if filepath.Ext(event.Name) == ".go" &&
-				(event.Op&fsnotify.Write == fsnotify.Write ||
-					event.Op&fsnotify.Create == fsnotify.Create) {
-				//event.Op&fsnotify.Rename == fsnotify.Rename) {
+// rootOf gets the watched tree that path is in
+func (f *watchFilter) rootOf(path string) string {
+	for _, r := range f.roots {
+		if isWithin(r, path) {
+			return r
+		}
+	}
+	return f.root
+}
 
-				typestring := eventToString(event)
-				logger.Debug().Str("name", event.Name).Str("type", typestring).Msg("notify event")
+// skipDir decides if we should not watch the directory or anything in it, and why
+func (f *watchFilter) skipDir(path string) (bool, string) {
+	if path == f.root {
+		return false, "target"
+	}
+	if path == f.rootOf(path) {
+		return false, "local dependency"
+	}
+	name := filepath.Base(path)
+	rel := f.rel(path)
+	for _, pattern := range f.watcher.Exclude {
+		if matchGlob(pattern, rel) {
+			return true, "excluded by pattern " + pattern
+		}
+	}
+	if strings.HasPrefix(name, ".") {
+		return true, "hidden directory"
+	}
+	if name == "vendor" {
+		return true, "vendor directory"
+	}
+	if f.gitignore != nil {
+		if rule, ok := f.gitignore.Match(path, true); ok {
+			return true, "ignored by " + rule.String()
+		}
+	}
+	return false, "directory"
+}
 
-				go func() {
-					w.OnEvent <- event.Name
-				}()
-			}
+// decideFile determines what to do when the file changes, and why
+func (f *watchFilter) decideFile(path string) (WatchAction, string) {
+	rel := f.rel(path)
+	root := f.rootOf(path)
+	// Anything inside a directory we skip is skipped too
+	for d := filepath.Dir(path); d != root && isWithin(root, d); d = filepath.Dir(d) {
+		if skip, reason := f.skipDir(d); skip {
+			return WatchActionIgnore, "in " + f.rel(d) + ", " + reason
+		}
+	}
+	if root != f.root {
+		return f.decideDependencyFile(path)
+	}
+	for _, pattern := range f.watcher.Exclude {
+		if matchGlob(pattern, rel) {
+			return WatchActionIgnore, "excluded by pattern " + pattern
+		}
+	}
+	for _, pattern := range f.watcher.Include {
+		if matchGlob(pattern, rel) {
+			return WatchActionRebuild, "included by pattern " + pattern
+		}
+	}
+	if f.watcher.Sources != nil && f.watcher.Sources.IsEmbedded(path) {
+		return WatchActionRebuild, "embedded in the binary"
+	}
+	switch filepath.Base(path) {
+	case "go.mod", "go.sum", "go.work", "go.work.sum":
+		return WatchActionRebuild, "module definition"
+	}
+	if f.gitignore != nil {
+		if rule, ok := f.gitignore.Match(path, false); ok {
+			return WatchActionIgnore, "ignored by " + rule.String()
+		}
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if action, ok := f.watcher.Extensions[ext]; ok {
+		if action == WatchActionRebuild && ext == ".go" {
+			return f.decideGoFile(path)
+		}
+		return action, "extension " + ext
+	}
+	return WatchActionIgnore, "no rule for extension '" + ext + "'"
+}
 
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return fmt.Errorf("Failed to get file watcher errors: %w", err)
-			} else {
-				return fmt.Errorf("Got watcher error: %w", err)
+// decideGoFile determines whether a change to a Go file changes the binary, and why
+func (f *watchFilter) decideGoFile(path string) (WatchAction, string) {
+	if strings.HasSuffix(path, "_test.go") {
+		if f.watcher.Tests {
+			return WatchActionRebuild, "test file"
+		}
+		return f.testOnly("test file")
+	}
+	if f.watcher.Sources == nil {
+		return WatchActionRebuild, "extension .go"
+	}
+	if ok, reason := f.watcher.Sources.Affects(path); ok {
+		return WatchActionRebuild, reason
+	} else {
+		return f.testOnly(reason)
+	}
+}
+
+// testOnly is the action for a Go file that doesn't go into the binary
+func (f *watchFilter) testOnly(reason string) (WatchAction, string) {
+	if f.watcher.RunTests {
+		return WatchActionTest, reason
+	}
+	return WatchActionIgnore, reason
+}
+
+// decideDependencyFile determines what to do when a file in a local
+// dependency changes. The browser can't load anything from a dependency
+// directly, so the only thing to do is rebuild.
+func (f *watchFilter) decideDependencyFile(path string) (WatchAction, string) {
+	if f.watcher.Sources != nil && f.watcher.Sources.IsEmbedded(path) {
+		return WatchActionRebuild, "embedded in the binary"
+	}
+	switch filepath.Base(path) {
+	case "go.mod", "go.sum":
+		return WatchActionRebuild, "module definition of a local dependency"
+	}
+	if f.gitignore != nil {
+		if rule, ok := f.gitignore.Match(path, false); ok {
+			return WatchActionIgnore, "ignored by " + rule.String()
+		}
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if f.watcher.Extensions[ext] == WatchActionRebuild {
+		if ext == ".go" {
+			return f.decideGoFile(path)
+		}
+		return WatchActionRebuild, "extension " + ext + " in a local dependency"
+	}
+	return WatchActionIgnore, "not part of building a local dependency"
+}
+
+// Explain writes every file under the target with what happens when it changes, and why
+func (w *Watcher) Explain(out io.Writer) error {
+	filter, err := w.newFilter()
+	if err != nil {
+		return err
+	}
+	for _, root := range filter.roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
 			}
+			if d.IsDir() {
+				if skip, reason := filter.skipDir(path); skip {
+					fmt.Fprintf(out, "%-8s %s/ (%s)\n", "skip", filter.rel(path), reason)
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			action, reason := filter.decideFile(path)
+			fmt.Fprintf(out, "%-8s %s (%s)\n", watchActionString(action), filter.rel(path), reason)
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 type opPair struct {
@@ -93,7 +535,7 @@ var eventTypeToSymbol = []opPair{
 	opPair{Op: fsnotify.Create, Sym: "C"},
 	opPair{Op: fsnotify.Write, Sym: "W"},
 	opPair{Op: fsnotify.Remove, Sym: "D"},
-	//opPair{Op: fsnotify.Rename, Sym: "R"},
+	opPair{Op: fsnotify.Rename, Sym: "R"},
 }
 
 func eventToString(event fsnotify.Event) string {
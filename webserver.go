@@ -8,8 +8,10 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 	"time"
 
+	"github.com/Gleipnir-Technology/flogo/process"
 	"github.com/Gleipnir-Technology/flogo/state"
 	"github.com/go-chi/chi/v5"
 	//"github.com/go-chi/chi/v5/middleware"
@@ -19,6 +21,41 @@ import (
 //go:embed index.html injector.js
 var embeddedFiles embed.FS
 
+type MessageAssetChanged struct {
+	Path string `json:"path"`
+}
+type MessageAnalyzer struct {
+	Diagnostics []MessageDiagnostic `json:"diagnostics"`
+	Status      string              `json:"status"`
+}
+type MessageDiagnostic struct {
+	Column  int    `json:"column"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+	Source  string `json:"source"`
+}
+
+func newMessageAnalyzer(a *state.Analyzer) *MessageAnalyzer {
+	if a == nil {
+		return nil
+	}
+	diagnostics := make([]MessageDiagnostic, 0, len(a.Diagnostics))
+	for _, d := range a.Diagnostics {
+		diagnostics = append(diagnostics, MessageDiagnostic{
+			Column:  d.Column,
+			File:    d.File,
+			Line:    d.Line,
+			Message: d.Message,
+			Source:  d.Source,
+		})
+	}
+	return &MessageAnalyzer{
+		Diagnostics: diagnostics,
+		Status:      state.StatusStringAnalyzer(a.Status),
+	}
+}
+
 type MessageHeartbeat struct {
 	Time time.Time `json:"time"`
 }
@@ -26,22 +63,70 @@ type MessageSSE struct {
 	Content interface{} `json:"content"`
 	Type    string      `json:"type"`
 }
+type MessageLine struct {
+	// Seconds since the process started
+	Elapsed float64 `json:"elapsed"`
+	// Whether the rest of the line hasn't arrived yet
+	Partial bool      `json:"partial"`
+	Seq     int       `json:"seq"`
+	Stream  string    `json:"stream"`
+	Text    string    `json:"text"`
+	Time    time.Time `json:"time"`
+}
 type MessageProcess struct {
-	ExitCode *int   `json:"exit_code"`
-	Output   string `json:"output"`
-	Stdout   string `json:"stdout"`
-	Stderr   string `json:"stderr"`
+	ExitCode *int `json:"exit_code"`
+	// The lines since the last message, then the partial lines, which replace
+	// the partial lines sent before
+	Lines []MessageLine `json:"lines"`
+	// Whether Lines replace the lines sent before instead of following them
+	Reset bool `json:"reset"`
+	// The sequence number of the oldest line that is kept, so the browser can
+	// drop the ones before it
+	Start int `json:"start"`
+	// The signal that ended the process, like "SIGTERM"
+	StopSignal string `json:"stop_signal"`
 }
 
-func newMessageProcess(s *state.Process) *MessageProcess {
+// outputCursor is how much of a process's output a connection has been sent
+type outputCursor struct {
+	lines *process.Lines
+	next  int
+}
+
+// newMessageProcess creates the message with the output of the process that
+// the connection hasn't been sent yet, keeping track of it by slot
+func (c *SSEConnection) newMessageProcess(slot string, s *state.Process) *MessageProcess {
 	if s == nil {
+		delete(c.sent, slot)
 		return nil
 	}
+	cursor, ok := c.sent[slot]
+	reset := !ok || cursor.lines != s.Output
+	if reset {
+		cursor = outputCursor{lines: s.Output}
+	}
+	complete, next := s.Output.Since(cursor.next)
+	cursor.next = next
+	c.sent[slot] = cursor
+
+	started := s.Output.Started()
+	lines := make([]MessageLine, 0, len(complete))
+	for _, line := range append(complete, s.Output.Partial()...) {
+		lines = append(lines, MessageLine{
+			Elapsed: line.Time.Sub(started).Seconds(),
+			Partial: line.Partial,
+			Seq:     line.Seq,
+			Stream:  line.Stream.String(),
+			Text:    line.Text(),
+			Time:    line.Time,
+		})
+	}
 	return &MessageProcess{
-		ExitCode: s.ExitCode,
-		Output:   string(s.Output),
-		Stderr:   string(s.Stderr),
-		Stdout:   string(s.Stdout),
+		ExitCode:   s.ExitCode,
+		Lines:      lines,
+		Reset:      reset,
+		Start:      next - s.Output.Len(),
+		StopSignal: s.StopSignal,
 	}
 }
 
@@ -50,28 +135,76 @@ type MessageStatus struct {
 	ProcessCurrent  *MessageProcess `json:"current"`
 	ProcessPrevious *MessageProcess `json:"previous"`
 }
+type MessageTestResult struct {
+	Elapsed float64 `json:"elapsed"`
+	Output  string  `json:"output"`
+	Package string  `json:"package"`
+	Test    string  `json:"test"`
+}
+type MessageTester struct {
+	Failed   int                 `json:"failed"`
+	Failures []MessageTestResult `json:"failures"`
+	Passed   int                 `json:"passed"`
+	Skipped  int                 `json:"skipped"`
+	Status   string              `json:"status"`
+}
+
+func newMessageTester(t *state.Tester) *MessageTester {
+	if t == nil {
+		return nil
+	}
+	passed, failed, skipped := t.Counts()
+	failures := make([]MessageTestResult, 0)
+	for _, r := range t.Failures() {
+		failures = append(failures, MessageTestResult{
+			Elapsed: r.Elapsed,
+			Output:  string(r.Output),
+			Package: r.Package,
+			Test:    r.Test,
+		})
+	}
+	return &MessageTester{
+		Failed:   failed,
+		Failures: failures,
+		Passed:   passed,
+		Skipped:  skipped,
+		Status:   state.StatusStringTester(t.Status),
+	}
+}
+
 type MessageState struct {
-	BuilderStatus MessageStatus `json:"builder"`
-	RunnerStatus  MessageStatus `json:"runner"`
+	// Nil when flogo isn't running analyzers
+	AnalyzerStatus *MessageAnalyzer `json:"analyzer"`
+	BuilderStatus  MessageStatus    `json:"builder"`
+	RunnerStatus   MessageStatus    `json:"runner"`
+	// Nil when flogo isn't running tests
+	TesterStatus *MessageTester `json:"tester"`
 }
 type SSEConnection struct {
-	chanState chan *state.Flogo
-	id        string
+	chanMessage chan MessageSSE
+	chanState   chan *state.Flogo
+	// closed when the client goes away
+	done chan struct{}
+	id   string
+	// How much of each process's output has been sent, by slot
+	sent map[string]outputCursor
 }
 
 func (c *SSEConnection) SendState(w http.ResponseWriter, s *state.Flogo) error {
 	return send(w, MessageSSE{
 		Content: MessageState{
+			AnalyzerStatus: newMessageAnalyzer(s.Analyzer),
 			BuilderStatus: MessageStatus{
-				ProcessCurrent:  newMessageProcess(s.Builder.BuildCurrent),
-				ProcessPrevious: newMessageProcess(s.Builder.BuildPrevious),
+				ProcessCurrent:  c.newMessageProcess("builder.current", s.Builder.BuildCurrent),
+				ProcessPrevious: c.newMessageProcess("builder.previous", s.Builder.BuildPrevious),
 				Status:          state.StatusStringBuilder(s.Builder.Status),
 			},
 			RunnerStatus: MessageStatus{
-				ProcessCurrent:  newMessageProcess(s.Runner.RunCurrent),
-				ProcessPrevious: newMessageProcess(s.Runner.RunPrevious),
+				ProcessCurrent:  c.newMessageProcess("runner.current", s.Runner.RunCurrent),
+				ProcessPrevious: c.newMessageProcess("runner.previous", s.Runner.RunPrevious),
 				Status:          state.StatusStringRunner(s.Runner.Status),
 			},
+			TesterStatus: newMessageTester(s.Tester),
 		},
 		Type: "state",
 	})
@@ -84,6 +217,9 @@ func (c *SSEConnection) SendHeartbeat(w http.ResponseWriter, t time.Time) error
 		Type: "heartbeat",
 	})
 }
+func (c *SSEConnection) SendMessage(w http.ResponseWriter, msg MessageSSE) error {
+	return send(w, msg)
+}
 func send[T any](w http.ResponseWriter, msg T) error {
 	jsonData, err := json.Marshal(msg)
 	if err != nil {
@@ -99,23 +235,55 @@ func send[T any](w http.ResponseWriter, msg T) error {
 	return nil
 }
 
+// newMessageAssetChanged creates the message that tells browsers to re-fetch a static file
+func newMessageAssetChanged(path string) MessageSSE {
+	return MessageSSE{
+		Content: MessageAssetChanged{
+			Path: path,
+		},
+		Type: "asset-changed",
+	}
+}
+
+// newMessageReload creates the message that tells browsers to reload the page
+func newMessageReload() MessageSSE {
+	return MessageSSE{
+		Content: nil,
+		Type:    "reload",
+	}
+}
+
 type Webserver struct {
 	connections map[*SSEConnection]bool
+	// Points proxied requests at the current upstream
+	director func(*http.Request)
+	mu       sync.Mutex
 }
 
 func NewWebserver() *Webserver {
 	return &Webserver{
 		connections: make(map[*SSEConnection]bool, 0),
+		mu:          sync.Mutex{},
 	}
 }
-func (web *Webserver) Run(ctx context.Context, chanOnState <-chan *state.Flogo, bind string, upstream url.URL) error {
+func (web *Webserver) Run(ctx context.Context, chanOnState <-chan *state.Flogo, chanOnMessage <-chan MessageSSE, bind string, upstream url.URL) error {
 	logger := log.Ctx(ctx)
 	r := chi.NewRouter()
 
 	//r.Use(middleware.Logger)
 	//r.Use(middleware.Recoverer)
 
-	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+	web.SetUpstream(upstream)
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			web.mu.Lock()
+			director := web.director
+			web.mu.Unlock()
+			director(r)
+			restrictAcceptEncoding(r)
+		},
+		ModifyResponse: injectResponse,
+	}
 
 	// Serve the embedded index.html for the root route
 	r.Get("/.flogo", func(w http.ResponseWriter, r *http.Request) {
@@ -133,12 +301,19 @@ func (web *Webserver) Run(ctx context.Context, chanOnState <-chan *state.Flogo,
 		proxy.ServeHTTP(w, r)
 	}))
 
-	go web.fanoutStateChanges(ctx, chanOnState)
+	go web.fanoutStateChanges(ctx, chanOnState, chanOnMessage)
 	logger.Info().Str("bind", bind).Msg("Started webserver loop")
 	return http.ListenAndServe(bind, r)
 }
 
-func (web *Webserver) fanoutStateChanges(ctx context.Context, chanOnState <-chan *state.Flogo) {
+// SetUpstream changes where proxied requests go
+func (web *Webserver) SetUpstream(upstream url.URL) {
+	director := httputil.NewSingleHostReverseProxy(&upstream).Director
+	web.mu.Lock()
+	defer web.mu.Unlock()
+	web.director = director
+}
+func (web *Webserver) fanoutStateChanges(ctx context.Context, chanOnState <-chan *state.Flogo, chanOnMessage <-chan MessageSSE) {
 	logger := log.Ctx(ctx)
 	for {
 		select {
@@ -146,12 +321,46 @@ func (web *Webserver) fanoutStateChanges(ctx context.Context, chanOnState <-chan
 			return
 		case state := <-chanOnState:
 			logger.Debug().Msg("new state in webserver for fanout")
-			for c, _ := range web.connections {
-				c.chanState <- state
+			for _, c := range web.connectionList() {
+				select {
+				case c.chanState <- state:
+				case <-c.done:
+				case <-ctx.Done():
+					return
+				}
+			}
+		case msg := <-chanOnMessage:
+			logger.Debug().Str("type", msg.Type).Msg("new message in webserver for fanout")
+			for _, c := range web.connectionList() {
+				select {
+				case c.chanMessage <- msg:
+				case <-c.done:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 	}
 }
+func (web *Webserver) addConnection(c *SSEConnection) {
+	web.mu.Lock()
+	defer web.mu.Unlock()
+	web.connections[c] = true
+}
+func (web *Webserver) connectionList() []*SSEConnection {
+	web.mu.Lock()
+	defer web.mu.Unlock()
+	result := make([]*SSEConnection, 0, len(web.connections))
+	for c := range web.connections {
+		result = append(result, c)
+	}
+	return result
+}
+func (web *Webserver) removeConnection(c *SSEConnection) {
+	web.mu.Lock()
+	defer web.mu.Unlock()
+	delete(web.connections, c)
+}
 
 // sseHandler handles the Server-Sent Events connection
 func (web *Webserver) sseHandler(w http.ResponseWriter, r *http.Request) {
@@ -162,10 +371,17 @@ func (web *Webserver) sseHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	connection := SSEConnection{
-		chanState: make(chan *state.Flogo),
-		id:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		chanMessage: make(chan MessageSSE),
+		chanState:   make(chan *state.Flogo),
+		done:        make(chan struct{}),
+		id:          fmt.Sprintf("%d", time.Now().UnixNano()),
+		sent:        make(map[string]outputCursor),
 	}
-	web.connections[&connection] = true
+	web.addConnection(&connection)
+	defer func() {
+		web.removeConnection(&connection)
+		close(connection.done)
+	}()
 	// Send an initial connected event
 	fmt.Fprintf(w, "event: connected\ndata: {\"status\": \"connected\", \"time\": \"%s\"}\n\n", time.Now().Format(time.RFC3339))
 	w.(http.Flusher).Flush()
@@ -191,6 +407,9 @@ func (web *Webserver) sseHandler(w http.ResponseWriter, r *http.Request) {
 		case state := <-connection.chanState:
 			log.Debug().Msg("Sending new state to connection")
 			err = connection.SendState(w, state)
+		case msg := <-connection.chanMessage:
+			log.Debug().Str("type", msg.Type).Msg("Sending message to connection")
+			err = connection.SendMessage(w, msg)
 		}
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to send state from webserver")